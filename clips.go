@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	digestDaily  = "day"
+	digestWeekly = "week"
+
+	defaultDigestCount = 10
+	// Discord allows at most 25 fields per embed.
+	maxDigestCount = 25
+)
+
+// runClipDigests posts the clip digest on its schedule. The last run is
+// saved to the config so a restart doesn't post the same digest twice.
+func runClipDigests() {
+	settings := &config.ClipDigest
+	if settings.Period != digestDaily && settings.Period != digestWeekly {
+		log.Printf("Invalid clip_digest period: %q\n", settings.Period)
+		return
+	}
+
+	for {
+		next := nextDigest(settings, time.Now().UTC())
+		log.Printf("Next clip digest at %v\n", next)
+		time.Sleep(time.Until(next))
+
+		postClipDigest(next)
+		configMu.Lock()
+		settings.LastRun = next.Unix()
+		configMu.Unlock()
+		writeConfig()
+	}
+}
+
+// nextDigest returns the next scheduled digest time after the last run.
+func nextDigest(settings *clipDigestSettings, now time.Time) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), settings.Hour, 0, 0, 0, time.UTC)
+	if settings.Period == digestWeekly {
+		next = next.AddDate(0, 0, -int((next.Weekday()+6)%7))
+	}
+	for !next.After(now) || next.Unix() <= settings.LastRun {
+		if settings.Period == digestWeekly {
+			next = next.AddDate(0, 0, 7)
+		} else {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+	return next
+}
+
+func postClipDigest(end time.Time) {
+	defer recoverLog("Posting clip digest")
+
+	settings := config.ClipDigest
+	start := end.AddDate(0, 0, -1)
+	if settings.Period == digestWeekly {
+		start = end.AddDate(0, 0, -7)
+	}
+	count := settings.Count
+	if count <= 0 {
+		count = defaultDigestCount
+	}
+	if count > maxDigestCount {
+		count = maxDigestCount
+	}
+
+	var clips []twitchClip
+	for _, stream := range config.Streams {
+		if stream.Type == twitchType && stream.UserId != "" {
+			streamClips, err := getTwitchClips(stream.UserId, start, end, count)
+			if err != nil {
+				log.Printf("Could not get clips for %v: %v\n", stream.StreamName, err)
+				continue
+			}
+			clips = append(clips, streamClips...)
+		}
+	}
+	if len(clips) == 0 {
+		log.Println("No clips for digest")
+		return
+	}
+	sort.SliceStable(clips, func(i, j int) bool {
+		return clips[i].ViewCount > clips[j].ViewCount
+	})
+	if len(clips) > count {
+		clips = clips[:count]
+	}
+
+	title := "Top clips of the day"
+	if settings.Period == digestWeekly {
+		title = "Top clips of the week"
+	}
+	embed := &discordgo.MessageEmbed{
+		Title: title,
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: start.Format("2 Jan") + " – " + end.Format("2 Jan 2006"),
+		},
+	}
+	if clips[0].Thumbnail != "" {
+		embed.Thumbnail = &discordgo.MessageEmbedThumbnail{URL: clips[0].Thumbnail}
+	}
+	for i, clip := range clips {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  fmt.Sprintf("%d. %v – %v", i+1, clip.BroadcasterName, clip.Title),
+			Value: fmt.Sprintf("[%d views](%v) · clipped by %v", clip.ViewCount, clip.URL, clip.CreatorName),
+		})
+	}
+
+	discord := createDiscordSession()
+	defer discord.Close()
+	for _, channelID := range settings.Channels {
+		if _, err := discord.ChannelMessageSendEmbed(channelID, embed); err != nil {
+			log.Printf("%v did not send: %v\n", channelID, err)
+		}
+	}
+}
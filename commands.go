@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// paintbotCommand is the /paintbot command. Each subcommand has a handler
+// in paintbotHandlers.
+var paintbotCommand = &discordgo.ApplicationCommand{
+	Name:        "paintbot",
+	Description: "PaintBot stream notifications",
+	// Guilds only see the streams posted to them, which a DM can't tell.
+	DMPermission: new(bool),
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "follow",
+			Description: "Get a DM when a stream goes live or posts a video",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "streamer",
+					Description: "Twitch name, YouTube @handle or channel URL",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "unfollow",
+			Description: "Stop getting DMs for a stream",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "streamer",
+					Description: "Twitch name, YouTube @handle or channel URL",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "live",
+			Description: "List the tracked streams that are live right now",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "status",
+			Description: "Show PaintBot's health",
+		},
+	},
+}
+
+var paintbotHandlers = map[string]func(*discordgo.Session, *discordgo.InteractionCreate, *discordgo.ApplicationCommandInteractionDataOption){
+	"follow":   handleFollow,
+	"unfollow": handleUnfollow,
+	"live":     handleLive,
+	"status":   handleStatus,
+}
+
+// registerCommands replaces the bot's global commands with /paintbot, so
+// running it on every start is safe.
+func registerCommands(discord *discordgo.Session) {
+	_, err := discord.ApplicationCommandBulkOverwrite(discord.State.User.ID, "", []*discordgo.ApplicationCommand{paintbotCommand})
+	if err != nil {
+		log.Printf("Could not register commands: %v\n", err)
+	}
+}
+
+func handleCommand(discord *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+	data := i.ApplicationCommandData()
+	if data.Name != paintbotCommand.Name || len(data.Options) == 0 {
+		return
+	}
+	defer recoverLog("Handling /paintbot " + data.Options[0].Name)
+
+	subcommand := data.Options[0]
+	if handler, ok := paintbotHandlers[subcommand.Name]; ok {
+		handler(discord, i, subcommand)
+	}
+}
+
+// commandOption returns the named string option of a subcommand.
+func commandOption(subcommand *discordgo.ApplicationCommandInteractionDataOption, name string) string {
+	for _, option := range subcommand.Options {
+		if option.Name == name {
+			return option.StringValue()
+		}
+	}
+	return ""
+}
+
+// interactionUser returns whoever ran a command, in a guild or a DM.
+func interactionUser(i *discordgo.InteractionCreate) *discordgo.User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+// findStreamByRef finds a tracked stream by Twitch name, YouTube channel id,
+// @handle or channel URL.
+func findStreamByRef(ref string) *streamInfo {
+	if stream := findChannel(ref, twitchType); stream != nil {
+		return stream
+	}
+	if stream := findChannel(ref, youtubeType); stream != nil {
+		return stream
+	}
+	for _, stream := range config.Streams {
+		if stream.Type == youtubeType && matchesYoutubeRef(stream, ref) {
+			return stream
+		}
+	}
+
+	youtubeRef, err := parseYoutubeChannelRef(ref)
+	if err != nil {
+		return nil
+	}
+	if youtubeRef.ChannelID == "" && channelResolver != nil {
+		youtubeRef.ChannelID, _ = channelResolver.resolveChannel(youtubeRef)
+	}
+	if youtubeRef.ChannelID == "" {
+		return nil
+	}
+	return findChannel(youtubeRef.ChannelID, youtubeType)
+}
+
+// findGuildStream is findStreamByRef limited to the streams posted in
+// guildID, so one server can't see or follow what only another tracks.
+func findGuildStream(discord *discordgo.Session, ref string, guildID string) *streamInfo {
+	stream := findStreamByRef(ref)
+	if stream == nil || !streamInGuild(discord, stream, guildID) {
+		return nil
+	}
+	return stream
+}
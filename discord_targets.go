@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	channelTypesMu sync.Mutex
+	channelTypes   = make(map[string]discordgo.ChannelType)
+	channelGuilds  = make(map[string]string)
+)
+
+// afterSend crossposts and opens a thread for a newly sent notification,
+// as configured on the target. title fills in the thread name's {title}.
+func afterSend(discord *discordgo.Session, channel *streamInfo, target *discordChannel, title string) {
+	if target.Crosspost && isNewsChannel(discord, target.ChannelID) {
+		if _, err := discord.ChannelMessageCrosspost(target.ChannelID, target.MessageID); err != nil {
+			log.Printf("%v did not crosspost: %v\n", target.MessageID, err)
+		}
+	}
+
+	if target.ThreadName != "" {
+		thread, err := discord.MessageThreadStartComplex(target.ChannelID, target.MessageID, &discordgo.ThreadStart{
+			Name:                threadName(target.ThreadName, channel, title),
+			AutoArchiveDuration: 1440,
+		})
+		if err != nil {
+			log.Printf("Could not open thread on %v: %v\n", target.MessageID, err)
+			return
+		}
+		target.ThreadID = thread.ID
+	}
+}
+
+// archiveThreads closes the discussion threads opened on go-live posts and
+// forgets them.
+func archiveThreads(targets []discordChannel) {
+	var discord *discordgo.Session
+	archived := true
+	for i, target := range targets {
+		if target.ThreadID == "" {
+			continue
+		}
+		if discord == nil {
+			discord = createDiscordSession()
+			defer discord.Close()
+		}
+		if _, err := discord.ChannelEdit(target.ThreadID, &discordgo.ChannelEdit{Archived: &archived}); err != nil {
+			log.Printf("Could not archive thread %v: %v\n", target.ThreadID, err)
+		}
+		targets[i].ThreadID = ""
+	}
+}
+
+func threadName(template string, channel *streamInfo, title string) string {
+	name := strings.NewReplacer(
+		"{streamer}", channel.StreamName,
+		"{title}", title,
+		"{date}", time.Now().Format("2 Jan 2006"),
+	).Replace(template)
+	if len([]rune(name)) > 100 {
+		name = string([]rune(name)[:100])
+	}
+	return name
+}
+
+// lookupChannel returns a channel's type and guild. They are cached since
+// channels don't change type or move guilds in practice.
+func lookupChannel(discord *discordgo.Session, channelID string) (discordgo.ChannelType, string, bool) {
+	channelTypesMu.Lock()
+	channelType, ok := channelTypes[channelID]
+	guildID := channelGuilds[channelID]
+	channelTypesMu.Unlock()
+	if ok {
+		return channelType, guildID, true
+	}
+
+	ch, err := discord.Channel(channelID)
+	if err != nil {
+		log.Printf("Could not look up channel %v: %v\n", channelID, err)
+		return 0, "", false
+	}
+	channelTypesMu.Lock()
+	channelTypes[channelID] = ch.Type
+	channelGuilds[channelID] = ch.GuildID
+	channelTypesMu.Unlock()
+	return ch.Type, ch.GuildID, true
+}
+
+// isNewsChannel reports whether channelID is an announcement channel.
+func isNewsChannel(discord *discordgo.Session, channelID string) bool {
+	channelType, _, ok := lookupChannel(discord, channelID)
+	return ok && channelType == discordgo.ChannelTypeGuildNews
+}
+
+// targetGuild returns the guild channelID belongs to, or "" if it can't be
+// looked up.
+func targetGuild(discord *discordgo.Session, channelID string) string {
+	_, guildID, _ := lookupChannel(discord, channelID)
+	return guildID
+}
+
+const (
+	buttonWatchTwitch  = "watch_twitch"
+	buttonWatchYoutube = "watch_youtube"
+	buttonVod          = "vod"
+	buttonSubscribe    = "subscribe"
+)
+
+// buttonLinks are the URLs available for a notification. Buttons whose link
+// is empty are left off.
+type buttonLinks struct {
+	Twitch    string
+	Youtube   string
+	Vod       string
+	Subscribe string
+}
+
+func twitchButtonLinks(channel *streamInfo, vod *twitchVideo) buttonLinks {
+	links := buttonLinks{
+		Twitch:    "https://www.twitch.tv/" + channel.StreamName,
+		Subscribe: "https://www.twitch.tv/subs/" + channel.StreamName,
+	}
+	if vod != nil {
+		links.Vod = vod.URL
+	}
+	return links
+}
+
+func youtubeButtonLinks(channel *streamInfo, videoId string) buttonLinks {
+	return buttonLinks{
+		Youtube:   "https://www.youtube.com/watch?v=" + videoId,
+		Subscribe: "https://www.youtube.com/channel/" + channel.ChannelID + "?sub_confirmation=1",
+	}
+}
+
+// linkButtons builds the button row for a target. Edits must always pass
+// the result, even when empty, since an edit without components clears them.
+func linkButtons(target discordChannel, links buttonLinks) []discordgo.MessageComponent {
+	labels := map[string]struct{ label, url string }{
+		buttonWatchTwitch:  {"Watch on Twitch", links.Twitch},
+		buttonWatchYoutube: {"Watch on YouTube", links.Youtube},
+		buttonVod:          {"Open VOD", links.Vod},
+		buttonSubscribe:    {"Subscribe", links.Subscribe},
+	}
+
+	var buttons []discordgo.MessageComponent
+	for _, name := range target.Buttons {
+		button, ok := labels[name]
+		if !ok || button.url == "" {
+			continue
+		}
+		buttons = append(buttons, discordgo.Button{
+			Label: button.label,
+			Style: discordgo.LinkButton,
+			URL:   button.url,
+		})
+	}
+	if len(buttons) == 0 {
+		return []discordgo.MessageComponent{}
+	}
+	return []discordgo.MessageComponent{discordgo.ActionsRow{Components: buttons}}
+}
+
+// findTarget returns the stream's configured target for a Discord channel.
+func findTarget(channel *streamInfo, channelID string) discordChannel {
+	for _, target := range channel.Channels {
+		if target.ChannelID == channelID {
+			return target
+		}
+	}
+	return discordChannel{ChannelID: channelID}
+}
+
+// editMessage replaces a message's embed and buttons.
+func editMessage(discord *discordgo.Session, target discordChannel, messageID string, embed *discordgo.MessageEmbed, links buttonLinks) error {
+	edit := discordgo.NewMessageEdit(target.ChannelID, messageID).SetEmbed(embed)
+	edit.Components = linkButtons(target, links)
+	_, err := discord.ChannelMessageEditComplex(edit)
+	return err
+}
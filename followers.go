@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// dmPacing spaces out follower DMs. discordgo waits out 429s itself, this
+// keeps a large fan-out from hitting them in the first place.
+const dmPacing = time.Second
+
+func handleFollow(discord *discordgo.Session, i *discordgo.InteractionCreate, subcommand *discordgo.ApplicationCommandInteractionDataOption) {
+	ref := commandOption(subcommand, "streamer")
+	stream := findGuildStream(discord, ref, i.GuildID)
+	if stream == nil {
+		respondEphemeral(discord, i, ref+" isn't a stream I track.")
+		return
+	}
+	user := interactionUser(i)
+
+	stream.mu.Lock()
+	found := false
+	for j := range stream.Followers {
+		if stream.Followers[j].UserID == user.ID {
+			stream.Followers[j].Disabled = false
+			found = true
+		}
+	}
+	if !found {
+		stream.Followers = append(stream.Followers, follower{UserID: user.ID})
+	}
+	stream.mu.Unlock()
+	writeConfig()
+
+	respondEphemeral(discord, i, "You'll get a DM from me when "+stream.StreamName+" posts. Make sure you allow DMs from this server.")
+}
+
+func handleUnfollow(discord *discordgo.Session, i *discordgo.InteractionCreate, subcommand *discordgo.ApplicationCommandInteractionDataOption) {
+	ref := commandOption(subcommand, "streamer")
+	// Anyone following a stream can drop it, even from a guild that no
+	// longer posts it.
+	stream := findStreamByRef(ref)
+	user := interactionUser(i)
+	following := false
+	if stream != nil {
+		stream.mu.Lock()
+		for j, f := range stream.Followers {
+			if f.UserID == user.ID {
+				stream.Followers = append(stream.Followers[:j], stream.Followers[j+1:]...)
+				following = true
+				break
+			}
+		}
+		stream.mu.Unlock()
+	}
+	if !following && (stream == nil || !streamInGuild(discord, stream, i.GuildID)) {
+		respondEphemeral(discord, i, ref+" isn't a stream I track.")
+		return
+	}
+	writeConfig()
+
+	respondEphemeral(discord, i, "You won't get DMs for "+stream.StreamName+" any more.")
+}
+
+// notifyFollowers DMs everyone following the stream. It runs in the
+// background so a large follower list doesn't hold up channel posts; the
+// caller must hold stream.mu.
+func notifyFollowers(stream *streamInfo, message *discordgo.MessageSend) {
+	var userIds []string
+	for _, f := range stream.Followers {
+		if !f.Disabled {
+			userIds = append(userIds, f.UserID)
+		}
+	}
+	if len(userIds) == 0 {
+		return
+	}
+	go sendFollowerDMs(stream, userIds, message)
+}
+
+func sendFollowerDMs(stream *streamInfo, userIds []string, message *discordgo.MessageSend) {
+	defer recoverLog("Sending DMs for " + stream.StreamName)
+
+	discord := createDiscordSession()
+	defer discord.Close()
+
+	var closed []string
+	for n, userId := range userIds {
+		if n > 0 {
+			time.Sleep(dmPacing)
+		}
+		dm, err := discord.UserChannelCreate(userId)
+		if err == nil {
+			_, err = discord.ChannelMessageSendComplex(dm.ID, message)
+		}
+		if err == nil {
+			continue
+		}
+		if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeCannotSendMessagesToThisUser {
+			log.Printf("DMs closed for %v, disabling their %v subscription\n", userId, stream.StreamName)
+			closed = append(closed, userId)
+			continue
+		}
+		log.Printf("Could not DM %v: %v\n", userId, err)
+	}
+
+	if len(closed) == 0 {
+		return
+	}
+	stream.mu.Lock()
+	for _, userId := range closed {
+		for j := range stream.Followers {
+			if stream.Followers[j].UserID == userId {
+				stream.Followers[j].Disabled = true
+			}
+		}
+	}
+	stream.mu.Unlock()
+	writeConfig()
+}
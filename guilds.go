@@ -0,0 +1,220 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// mergeGuilds folds the guilds section into config.Streams. Each guild
+// target becomes a target on the shared stream for that streamer, so
+// EventSub and WebSub are only set up once however many guilds follow it.
+// Targets from a previous load keep their message, thread and role ids.
+func mergeGuilds() {
+	declared := make(map[*streamInfo][]discordChannel)
+	for _, guild := range config.Guilds {
+		for _, entry := range guild.Streams {
+			stream := guildUpstream(entry)
+			for _, target := range entry.Channels {
+				target.GuildID = guild.GuildID
+				target.Description = firstNonEmpty(target.Description, entry.Description, guild.Description)
+				target.ColourString = firstNonEmpty(target.ColourString, entry.Colour, guild.Colour)
+				target.NotifyRole = target.NotifyRole || entry.NotifyRole
+				declared[stream] = append(declared[stream], target)
+			}
+		}
+	}
+
+	var streams []*streamInfo
+	for _, stream := range config.Streams {
+		var targets []discordChannel
+		for _, target := range stream.Channels {
+			if target.GuildID == "" {
+				targets = append(targets, target)
+			}
+		}
+		for _, target := range declared[stream] {
+			for _, old := range stream.Channels {
+				if old.GuildID == target.GuildID && old.ChannelID == target.ChannelID {
+					target.MessageID = old.MessageID
+					target.ThreadID = old.ThreadID
+					if target.RoleID == "" {
+						target.RoleID = old.RoleID
+					}
+					break
+				}
+			}
+			targets = append(targets, target)
+		}
+		stream.Channels = targets
+
+		if stream.GuildOnly && len(declared[stream]) == 0 {
+			continue
+		}
+		streams = append(streams, stream)
+	}
+	config.Streams = streams
+}
+
+// guildUpstream finds the shared stream a guild entry refers to, adding one
+// if no guild or top-level entry has asked for the streamer yet.
+func guildUpstream(entry guildStream) *streamInfo {
+	for _, stream := range config.Streams {
+		if stream.Type != entry.Type {
+			continue
+		}
+		if entry.StreamName != "" && strings.EqualFold(stream.StreamName, entry.StreamName) {
+			return stream
+		}
+		if entry.ChannelRef != "" && matchesYoutubeRef(stream, entry.ChannelRef) {
+			return stream
+		}
+	}
+
+	stream := &streamInfo{
+		StreamName: entry.StreamName,
+		ChannelRef: entry.ChannelRef,
+		Type:       entry.Type,
+		GuildOnly:  true,
+	}
+	config.Streams = append(config.Streams, stream)
+	return stream
+}
+
+// matchesYoutubeRef reports whether ref is already known to name stream's
+// channel, without asking the resolver.
+func matchesYoutubeRef(stream *streamInfo, ref string) bool {
+	if ref == stream.ChannelRef || (stream.ChannelID != "" && ref == stream.ChannelID) {
+		return true
+	}
+	if parsed, err := parseYoutubeChannelRef(ref); err == nil && parsed.ChannelID != "" && parsed.ChannelID == stream.ChannelID {
+		return true
+	}
+	for _, alias := range stream.Aliases {
+		if ref == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeYoutubeDuplicates folds YouTube streams that resolved to the same
+// channel into one, so an @handle in one guild and a /channel/ URL in another
+// don't end up with two subscriptions and two pollers. The folded-in
+// reference is kept as an alias so the next load matches it straight away.
+func mergeYoutubeDuplicates() {
+	byChannel := make(map[string]int)
+	var streams []*streamInfo
+	for _, stream := range config.Streams {
+		if stream.Type != youtubeType || stream.ChannelID == "" {
+			streams = append(streams, stream)
+			continue
+		}
+		i, ok := byChannel[stream.ChannelID]
+		if !ok {
+			byChannel[stream.ChannelID] = len(streams)
+			streams = append(streams, stream)
+			continue
+		}
+		keep, dup := streams[i], stream
+		if keep.GuildOnly && !dup.GuildOnly {
+			// Settings from the streams list win over a guild-only entry.
+			keep, dup = dup, keep
+			streams[i] = keep
+		}
+		log.Printf("%v and %v are both youtube channel %v, merging\n", keep.ChannelRef, dup.ChannelRef, keep.ChannelID)
+		mergeStream(keep, dup)
+	}
+	config.Streams = streams
+}
+
+// mergeStream moves dup's targets, posted videos and followers onto keep.
+func mergeStream(keep *streamInfo, dup *streamInfo) {
+	keep.GuildOnly = keep.GuildOnly && dup.GuildOnly
+	for _, alias := range append([]string{dup.ChannelRef}, dup.Aliases...) {
+		if alias != "" && !matchesYoutubeRef(keep, alias) {
+			keep.Aliases = append(keep.Aliases, alias)
+		}
+	}
+
+	for _, target := range dup.Channels {
+		if !hasTarget(keep, target) {
+			keep.Channels = append(keep.Channels, target)
+		}
+	}
+	for _, video := range dup.Videos.sorted() {
+		if !keep.Videos.has(video.VideoID) {
+			keep.Videos.add(video)
+		}
+	}
+	for _, broadcast := range dup.Broadcasts {
+		if findBroadcast(keep, broadcast.VideoID) == nil {
+			keep.Broadcasts = append(keep.Broadcasts, broadcast)
+		}
+	}
+	following := make(map[string]bool)
+	for _, f := range keep.Followers {
+		following[f.UserID] = true
+	}
+	for _, f := range dup.Followers {
+		if !following[f.UserID] {
+			keep.Followers = append(keep.Followers, f)
+		}
+	}
+}
+
+func hasTarget(stream *streamInfo, target discordChannel) bool {
+	for _, existing := range stream.Channels {
+		if existing.ChannelID == target.ChannelID && existing.GuildID == target.GuildID {
+			return true
+		}
+	}
+	return false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// targetDescription is the text posted above a notification in target.
+func targetDescription(stream *streamInfo, target discordChannel) string {
+	if target.Description != "" {
+		return target.Description
+	}
+	return stream.Description
+}
+
+// targetEmbed applies target's colour override to embed, copying it so the
+// other targets keep the stream's colour.
+func targetEmbed(target discordChannel, embed *discordgo.MessageEmbed) *discordgo.MessageEmbed {
+	if target.ColourString == "" {
+		return embed
+	}
+	copied := *embed
+	copied.Color = int(target.HighlightColour)
+	return &copied
+}
+
+// streamInGuild reports whether any of the stream's targets is in guildID.
+func streamInGuild(discord *discordgo.Session, stream *streamInfo, guildID string) bool {
+	if guildID == "" {
+		return false
+	}
+	for _, target := range stream.Channels {
+		if target.GuildID == guildID || targetGuild(discord, target.ChannelID) == guildID {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsRole reports whether target should get an opt-in notification role.
+func wantsRole(stream *streamInfo, target discordChannel) bool {
+	return stream.NotifyRole || target.NotifyRole
+}
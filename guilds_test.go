@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+)
+
+func withConfig(t *testing.T, c *cofiguration) {
+	old := config
+	config = c
+	t.Cleanup(func() { config = old })
+}
+
+func TestMergeGuildsSharesStreams(t *testing.T) {
+	withConfig(t, &cofiguration{
+		Streams: []*streamInfo{{StreamName: "Painter", Type: twitchType, Description: "shared"}},
+		Guilds: []guildConfig{
+			{GuildID: "g1", Description: "guild one", Streams: []guildStream{
+				{StreamName: "painter", Type: twitchType, Channels: []discordChannel{{ChannelID: "c1"}}},
+			}},
+			{GuildID: "g2", Colour: "0xff0000", Streams: []guildStream{
+				{StreamName: "PAINTER", Type: twitchType, Description: "stream in g2", Channels: []discordChannel{{ChannelID: "c2"}}},
+				{StreamName: "other", Type: twitchType, Channels: []discordChannel{{ChannelID: "c3"}}},
+			}},
+		},
+	})
+
+	mergeGuilds()
+	if len(config.Streams) != 2 {
+		t.Fatalf("got %d streams, want 2", len(config.Streams))
+	}
+	painter := config.Streams[0]
+	if len(painter.Channels) != 2 {
+		t.Fatalf("painter has %d targets, want 2", len(painter.Channels))
+	}
+	if got := targetDescription(painter, painter.Channels[0]); got != "guild one" {
+		t.Errorf("g1 description %q", got)
+	}
+	if got := targetDescription(painter, painter.Channels[1]); got != "stream in g2" {
+		t.Errorf("g2 description %q", got)
+	}
+	if painter.Channels[1].ColourString != "0xff0000" {
+		t.Errorf("g2 colour %q", painter.Channels[1].ColourString)
+	}
+	if !config.Streams[1].GuildOnly {
+		t.Error("stream only a guild asked for is not marked guild_only")
+	}
+
+	// A reload keeps message ids and drops targets the guilds no longer
+	// list, along with streams nobody wants any more.
+	painter.Channels[0].MessageID = "m1"
+	config.Guilds = config.Guilds[:1]
+	mergeGuilds()
+	if len(config.Streams) != 1 || len(config.Streams[0].Channels) != 1 {
+		t.Fatalf("after removing g2: %+v", config.Streams)
+	}
+	if config.Streams[0].Channels[0].MessageID != "m1" {
+		t.Error("message id lost on reload")
+	}
+}
+
+func TestMergeYoutubeDuplicates(t *testing.T) {
+	const id = "UCabcdefghijklmnopqrstuv"
+	handle := &streamInfo{Type: youtubeType, ChannelRef: "@someone", ChannelID: id, GuildOnly: true,
+		Channels: []discordChannel{{ChannelID: "c1", GuildID: "g1"}}}
+	url := &streamInfo{Type: youtubeType, ChannelRef: "https://www.youtube.com/channel/" + id, ChannelID: id,
+		Channels: []discordChannel{{ChannelID: "c2"}}}
+	handle.Videos.add(&postedVideo{VideoID: "v1"})
+	withConfig(t, &cofiguration{Streams: []*streamInfo{handle, url}})
+
+	mergeYoutubeDuplicates()
+	if len(config.Streams) != 1 {
+		t.Fatalf("got %d streams, want 1", len(config.Streams))
+	}
+	merged := config.Streams[0]
+	if merged != url {
+		t.Error("guild-only stream kept over the configured one")
+	}
+	if len(merged.Channels) != 2 || !merged.Videos.has("v1") || merged.GuildOnly {
+		t.Errorf("merged stream %+v", merged)
+	}
+
+	// The next load finds the shared stream from the other reference.
+	if guildUpstream(guildStream{Type: youtubeType, ChannelRef: "@someone"}) != merged {
+		t.Error("alias did not match the merged stream")
+	}
+}
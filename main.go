@@ -3,12 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -23,6 +25,9 @@ var (
 	oauth2Config *clientcredentials.Config
 	client       *http.Client
 	config       *cofiguration
+	// botSession is the gateway connection opened in main, for anything
+	// that needs more than REST calls. It's guarded by presenceMu.
+	botSession *discordgo.Session
 )
 
 const cfgFile string = "cfg.txt"
@@ -39,42 +44,98 @@ func main() {
 	loadConfig()
 	//bytes, err := json.Marshal(config)
 	//log.Println(string(bytes))
-	generateToken()
+	if err := generateToken(); err != nil {
+		log.Fatal(err)
+	}
 	log.Println("Token Generated")
 	client = &http.Client{}
+	if config.Secrets.YoutubeAPIKey != "" {
+		youtubeClient := newYoutubeDataClient(config.Secrets.YoutubeAPIKey, client)
+		videoFetcher = youtubeClient
+		channelResolver = youtubeClient
+		go watchYoutubeBroadcasts(5 * time.Minute)
+	}
 
 	go startListen()
+	startStatsPoller()
 
-	subs := getSubscriptions("webhook_callback_verification_failed")
-
+	subs, err := getSubscriptions("webhook_callback_verification_failed")
+	if err != nil {
+		log.Printf("Could not list failed subscriptions: %v\n", err)
+	}
 	for _, subToDelete := range subs.Data {
-		deleteSubscription(subToDelete.ID)
+		if err := deleteSubscription(subToDelete.ID); err != nil {
+			log.Printf("Could not delete subscription %v: %v\n", subToDelete.ID, err)
+		}
 	}
 
-	enabledSubs := getSubscriptions("enabled")
+	// YouTube channels are resolved up front so streams that name the same
+	// channel differently can share one subscription.
+	for _, currStream := range config.Streams {
+		if currStream.Type == youtubeType {
+			if err := resolveYoutubeChannel(currStream); err != nil {
+				streamError(currStream, "Could not resolve youtube channel for %v: %v\n", currStream.StreamName, err)
+			}
+		}
+	}
+	mergeYoutubeDuplicates()
+
+	enabledSubs, err := getSubscriptions("enabled")
+	if err != nil {
+		log.Printf("Could not list enabled subscriptions: %v\n", err)
+	}
 	for _, currStream := range config.Streams {
 		if currStream.Type == twitchType {
 			log.Println(currStream.StreamName)
 			if len(currStream.UserId) < 1 {
-				currStream.UserId = getTwitchUser(currStream.StreamName).ID
-			}
-			subEnabled := false
-			for _, sub := range enabledSubs.Data {
-				if sub.Condition["broadcaster_user_id"] == currStream.UserId {
-					subEnabled = true
-					break
+				user, err := getTwitchUser(currStream.StreamName)
+				if err != nil {
+					streamError(currStream, "Could not look up twitch user %v: %v\n", currStream.StreamName, err)
+					continue
 				}
+				currStream.UserId = user.ID
 			}
-			if subEnabled {
+			if config.DetectionMode == detectionPoll {
 				continue
 			}
-			registerTwitchWebhook(client, currStream.UserId, "stream.online")
-			registerTwitchWebhook(client, currStream.UserId, "stream.offline")
-			registerTwitchWebhook(client, currStream.UserId, "channel.update")
+			for _, sub := range twitchSubscriptionsFor(currStream) {
+				if hasSubscription(enabledSubs, sub.EventType, sub.Condition) {
+					continue
+				}
+				if err := registerTwitchWebhook(sub); err != nil {
+					streamError(currStream, "Could not register %v for %v: %v\n", sub.EventType, currStream.StreamName, err)
+				}
+			}
 		} else if currStream.Type == youtubeType {
+			if currStream.ChannelID == "" {
+				continue
+			}
 			setupYouTubeNotification(currStream)
+			if currStream.FeedPoll != "" {
+				interval, err := time.ParseDuration(currStream.FeedPoll)
+				if err != nil {
+					log.Printf("Invalid feed_poll_interval for %v: %v\n", currStream.StreamName, err)
+				} else {
+					go pollYoutubeFeed(currStream, interval)
+				}
+			}
 		}
 	}
+	writeConfig()
+	go saveConfigs()
+
+	if config.DetectionMode == detectionPoll {
+		go pollTwitchStreams()
+	}
+	if config.VodPollInterval != "" {
+		go pollTwitchVods()
+	}
+	if len(config.ClipDigest.Channels) > 0 {
+		go runClipDigests()
+	}
+	if config.ScheduleInterval != "" {
+		go syncSchedules()
+	}
 
 	discord := createDiscordSession()
 	errCheck("error retrieving account", err)
@@ -83,13 +144,25 @@ func main() {
 		servers := discord.State.Guilds
 		log.Printf("PaintBot has started on %d servers\n", len(servers))
 	})
-
-	log.Println(getSubscriptions("enabled"))
+	discord.AddHandler(handleRoleButton)
+	discord.AddHandler(handleRoleDelete)
+	discord.AddHandler(handleCommand)
+	watchPermissions(discord)
 
 	err = discord.Open()
 	errCheck("Error opening connection to Discord", err)
 	defer discord.Close()
 
+	registerCommands(discord)
+	setupNotificationRoles(discord)
+	go checkPermissions(discord)
+
+	presenceMu.Lock()
+	botSession = discord
+	presenceMu.Unlock()
+	updatePresence()
+	go rotatePresence()
+
 	<-make(chan struct{})
 }
 
@@ -108,6 +181,15 @@ func errCheck(msg string, err error) {
 	}
 }
 
+// recoverLog stops a panic in a background job from taking down the bot. The
+// HTTP server recovers handler panics, but one in a goroutine of our own is
+// fatal.
+func recoverLog(job string) {
+	if r := recover(); r != nil {
+		log.Printf("%s failed: %v", job, r)
+	}
+}
+
 func loadConfig() {
 	content, err := ioutil.ReadFile(cfgFile)
 	if err != nil {
@@ -115,9 +197,10 @@ func loadConfig() {
 	}
 
 	json.Unmarshal(content, &config)
+	mergeGuilds()
 
 	for _, channel := range config.Streams {
-		if channel.Type == twitchType {
+		if channel.ColourString != "" {
 			colour, err := strconv.ParseInt(channel.ColourString, 0, 64)
 			if err != nil {
 				log.Fatal(err)
@@ -125,10 +208,44 @@ func loadConfig() {
 			}
 			channel.HighlightColour = colour
 		}
+		for i := range channel.Channels {
+			target := &channel.Channels[i]
+			if target.ColourString == "" {
+				continue
+			}
+			colour, err := strconv.ParseInt(target.ColourString, 0, 64)
+			if err != nil {
+				log.Fatalf("invalid colour for %v in %v: %v", channel.StreamName, target.ChannelID, err)
+			}
+			target.HighlightColour = colour
+		}
+		if channel.Type == twitchType {
+			switch channel.OfflineAction {
+			case "", offlineSummary, offlineDelete, offlineNone:
+			default:
+				log.Fatalf("invalid offline_action for %v: %q", channel.StreamName, channel.OfflineAction)
+			}
+			setState(channel, currentState(channel, time.Now()))
+			if channel.Session != nil {
+				channel.Session.migrateSamples()
+				restoreSamples(channel.Session)
+			}
+		}
+		if channel.Type == youtubeType {
+			if err := compileYoutubeFilters(&channel.Filters); err != nil {
+				log.Fatalf("invalid youtube_filters for %v: %v", channel.StreamName, err)
+			}
+			if channel.VideoRetention.MaxAge != "" {
+				if _, err := time.ParseDuration(channel.VideoRetention.MaxAge); err != nil {
+					log.Fatalf("invalid video_retention for %v: %v", channel.StreamName, err)
+				}
+			}
+			migrateVideoIds(channel)
+		}
 	}
 }
 
-func generateToken() {
+func generateToken() error {
 	oauth2Config = &clientcredentials.Config{
 		ClientID:     config.Secrets.TwitchClientID,
 		ClientSecret: config.Secrets.TwitchClientSecret,
@@ -137,26 +254,27 @@ func generateToken() {
 
 	token, err := oauth2Config.Token(context.Background())
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	twitchToken = token
+	return nil
 }
 
-func validateToken() {
+func validateToken() error {
 	req, _ := http.NewRequest("GET", "https://id.twitch.tv/oauth2/validate", nil)
 	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
 	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
 		log.Println("Token validated")
-		return
+		return nil
 	}
-	generateToken()
+	return generateToken()
 }
 
 func handleRoot(w http.ResponseWriter, r *http.Request) (err error) {
@@ -199,36 +317,32 @@ func handleTwitchNotification(w http.ResponseWriter, r *http.Request) (err error
 	if err != nil {
 		log.Println(err)
 	}
+	switch twitchNotif.SubscriptionInfo.Type {
+	case "channel.raid":
+		handleRaid(twitchNotif.Event)
+		return
+	case "channel.shoutout.create":
+		handleShoutout(twitchNotif.Event)
+		return
+	}
+
 	log.Println("Webhook notification for: ", twitchNotif.Event["broadcaster_user_name"], twitchNotif.SubscriptionInfo.Type)
 	channel := findChannel(twitchNotif.Event["broadcaster_user_name"].(string), twitchType)
 
-	if twitchNotif.SubscriptionInfo.Type == "stream.online" {
-		if len(channel.Title) == 0 {
-			twitchChannel := getTwitchChannel(channel.UserId)
-			channel.Title = twitchChannel.Title
-			channel.Category = twitchChannel.GameID
-		}
-		onlineDate, _ := time.Parse(time.RFC3339, twitchNotif.Event["started_at"].(string))
+	if channel == nil {
+		return
+	}
 
-		if channel.DisableOffline || onlineDate.Unix()-channel.LastOffline > channel.OfflineTime {
-			postNotification(channel)
-		}
-		channel.IsLive = true
-	} else if twitchNotif.SubscriptionInfo.Type == "stream.offline" {
-		if !channel.IsLive {
-			log.Println("Channel is already offline, ignoring notification")
-			return
-		}
-		channel.IsLive = false
-		channel.LastOffline = time.Now().Unix()
-		writeConfig()
-	} else if twitchNotif.SubscriptionInfo.Type == "channel.update" {
-		channel.Title = twitchNotif.Event["title"].(string)
-		channel.Category = twitchNotif.Event["category_id"].(string)
-
-		if channel.IsLive {
-			go postNotification(channel)
-		}
+	switch twitchNotif.SubscriptionInfo.Type {
+	case "stream.online":
+		onlineDate, _ := time.Parse(time.RFC3339, twitchNotif.Event["started_at"].(string))
+		streamId, _ := twitchNotif.Event["id"].(string)
+		streamType, _ := twitchNotif.Event["type"].(string)
+		streamOnline(channel, streamId, streamType, onlineDate)
+	case "stream.offline":
+		streamOffline(channel)
+	case "channel.update":
+		channelUpdate(channel, twitchNotif.Event["title"].(string), twitchNotif.Event["category_id"].(string))
 	}
 
 	return
@@ -271,13 +385,21 @@ func startListen() {
 	go log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
-func postNotification(channel *streamInfo) {
+// postNotification sends the live embed to each of the stream's channels, or
+// edits the existing messages when edit is set. The caller must hold
+// channel.mu.
+func postNotification(channel *streamInfo, edit bool) {
 	log.Println("Posting notification")
-	user := getTwitchUser(channel.StreamName)
+	user, err := getTwitchUser(channel.StreamName)
+	if err != nil {
+		log.Printf("Could not look up %v: %v\n", channel.StreamName, err)
+	}
 
 	var game *twitchGame
 	if len(channel.Category) > 0 {
-		game = getTwitchGame(channel.Category)
+		if game, err = getTwitchGame(channel.Category); err != nil {
+			log.Printf("Could not look up game %v: %v\n", channel.Category, err)
+		}
 	}
 	if game == nil {
 		game = &twitchGame{
@@ -285,13 +407,23 @@ func postNotification(channel *streamInfo) {
 			BoxArt: "https://images.igdb.com/igdb/image/upload/t_cover_big/nocover_qhhlj6.png",
 		}
 	}
+	streamType := streamTypeLive
+	if channel.Session != nil && channel.Session.StreamType != "" {
+		streamType = channel.Session.StreamType
+	}
+	style, ok := streamStyles[streamType]
+	if !ok {
+		style = streamStyles[streamTypeLive]
+	}
+	colour := int(channel.HighlightColour)
+	if style.colour != 0 {
+		colour = style.colour
+	}
+
 	embed := &discordgo.MessageEmbed{
-		Author: &discordgo.MessageEmbedAuthor{
-			URL:     "https://www.twitch.tv/" + channel.StreamName,
-			Name:    channel.StreamName,
-			IconURL: strings.Replace(strings.Replace(user.ProfileImage, "{width}", "70", 1), "{height}", "70", 1),
-		},
-		Color: int(channel.HighlightColour),
+		Author:      twitchEmbedAuthor(channel, user),
+		Color:       colour,
+		Description: style.label,
 		Fields: []*discordgo.MessageEmbedField{
 			{
 				Name:   "Game",
@@ -308,26 +440,54 @@ func postNotification(channel *streamInfo) {
 		Title: channel.Title,
 		URL:   "https://www.twitch.tv/" + channel.StreamName,
 	}
+	if channel.ShowLiveStats && channel.Session != nil {
+		if viewers, ok := channel.Session.currentViewers(); ok {
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+				Name:   "Viewers",
+				Value:  strconv.Itoa(viewers),
+				Inline: true,
+			})
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   "Uptime",
+			Value:  formatUptime(channel.Session.duration()),
+			Inline: true,
+		})
+	}
+	if channel.Session != nil && len(channel.Session.Reconnects) > 0 {
+		last := channel.Session.Reconnects[len(channel.Session.Reconnects)-1]
+		embed.Footer = &discordgo.MessageEmbedFooter{
+			Text: fmt.Sprintf("Reconnected after %v offline", time.Unix(last.OnlineAt, 0).Sub(time.Unix(last.OfflineAt, 0)).Round(time.Second)),
+		}
+	}
 
 	discord := createDiscordSession()
 	defer discord.Close()
-	message := &discordgo.MessageSend{
-		Embeds: []*discordgo.MessageEmbed{embed},
-	}
+	message := &discordgo.MessageSend{}
 
-	if channel.Description != "" {
-		message.Content = channel.Description
+	if !style.ping {
+		message.AllowedMentions = &discordgo.MessageAllowedMentions{}
 	}
 
+	links := twitchButtonLinks(channel, nil)
 	var msg *discordgo.Message
-	var err error
 	for i, channelID := range channel.Channels {
-		if channel.IsLive {
+		message.Content = roleMention(channel, channelID) + targetDescription(channel, channelID)
+		message.Components = linkButtons(channelID, links)
+		message.Embeds = []*discordgo.MessageEmbed{embed}
+		if style.colour == 0 {
+			message.Embeds[0] = targetEmbed(channelID, embed)
+		}
+		// Messages deleted at offline can't be edited back on a resume, so
+		// those targets get a fresh message.
+		if edit && channelID.MessageID != "" {
 			messageEdit := &discordgo.MessageEdit{
-				ID:      channelID.MessageID,
-				Channel: channelID.ChannelID,
-				Content: &message.Content,
-				Embeds:  message.Embeds,
+				ID:              channelID.MessageID,
+				Channel:         channelID.ChannelID,
+				Content:         &message.Content,
+				Components:      message.Components,
+				Embeds:          message.Embeds,
+				AllowedMentions: message.AllowedMentions,
 			}
 			msg, err = discord.ChannelMessageEditComplex(messageEdit)
 		} else {
@@ -335,31 +495,79 @@ func postNotification(channel *streamInfo) {
 		}
 
 		if err != nil {
-			log.Printf("%v did not send: %v\n", msg, err)
+			streamError(channel, "%v did not send: %v\n", channelID.ChannelID, err)
 		} else {
-			channel.Channels[i].MessageID = msg.ID
+			if channel.Channels[i].MessageID != msg.ID {
+				channel.Channels[i].MessageID = msg.ID
+				afterSend(discord, channel, &channel.Channels[i], channel.Title)
+			}
 		}
 	}
+	channel.postedTitle = channel.Title
+	channel.postedCategory = channel.Category
 	writeConfig()
 }
 
+var (
+	// configMu guards the persisted config fields outside Streams. Each
+	// stream's own fields are guarded by its mu.
+	configMu    sync.Mutex
+	configDirty = make(chan struct{}, 1)
+)
+
+// writeConfig asks for cfg.txt to be saved. Callers often hold a stream's
+// mu, so the save itself happens on saveConfigs' goroutine, which takes each
+// stream's lock in turn.
 func writeConfig() {
-	f, err := os.OpenFile("cfg.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
-	if err != nil {
-		log.Fatal(err)
+	select {
+	case configDirty <- struct{}{}:
+	default:
+	}
+}
+
+// saveConfigs saves cfg.txt whenever writeConfig has been called.
+func saveConfigs() {
+	for range configDirty {
+		if err := saveConfig(); err != nil {
+			log.Printf("Could not save config: %v\n", err)
+		}
+	}
+}
+
+// saveConfig snapshots each stream under its lock and replaces cfg.txt in
+// one rename, so a crash mid-write can't leave it truncated.
+func saveConfig() error {
+	streams := make([]json.RawMessage, len(config.Streams))
+	for i, stream := range config.Streams {
+		stream.mu.Lock()
+		bytes, err := json.Marshal(stream)
+		stream.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		streams[i] = bytes
 	}
-	defer f.Close()
 
-	bytes, err := json.Marshal(config)
+	configMu.Lock()
+	bytes, err := json.Marshal(struct {
+		*cofiguration
+		Streams []json.RawMessage `json:"streams"`
+	}{config, streams})
+	configMu.Unlock()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	tmp := cfgFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, bytes, 0755); err != nil {
+		return err
 	}
-	f.Write(bytes)
+	return os.Rename(tmp, cfgFile)
 }
 
 func findChannel(name string, channelType int) (channel *streamInfo) {
 	for _, currChannel := range config.Streams {
-		if (strings.EqualFold(currChannel.StreamName, name) || strings.EqualFold(currChannel.UserId, name)) && currChannel.Type == channelType {
+		if (strings.EqualFold(currChannel.StreamName, name) || strings.EqualFold(currChannel.UserId, name) || strings.EqualFold(currChannel.ChannelID, name)) && currChannel.Type == channelType {
 			return currChannel
 		}
 	}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// permissionProblem is a target channel the bot can't fully post to.
+type permissionProblem struct {
+	Stream    string
+	GuildID   string
+	ChannelID string
+	Missing   []string
+}
+
+var (
+	permissionsMu sync.Mutex
+	// permissionProblems is the result of the last check, for /paintbot
+	// status.
+	permissionProblems []permissionProblem
+	permissionTimer    *time.Timer
+)
+
+var permissionNames = []struct {
+	permission int64
+	name       string
+}{
+	{discordgo.PermissionViewChannel, "View Channel"},
+	{discordgo.PermissionSendMessages, "Send Messages"},
+	{discordgo.PermissionEmbedLinks, "Embed Links"},
+	{discordgo.PermissionMentionEveryone, "Mention Everyone"},
+	{discordgo.PermissionCreatePublicThreads, "Create Public Threads"},
+}
+
+const postPermissions = discordgo.PermissionViewChannel | discordgo.PermissionSendMessages | discordgo.PermissionEmbedLinks
+
+// requiredPermissions is what the bot needs in target to post, edit and
+// clean up the stream's notifications as configured. Editing, deleting and
+// crossposting only ever touch the bot's own messages, which Discord allows
+// without Manage Messages.
+func requiredPermissions(stream *streamInfo, target discordChannel) int64 {
+	required := int64(postPermissions)
+	if pings(targetDescription(stream, target)) {
+		required |= discordgo.PermissionMentionEveryone
+	}
+	if target.ThreadName != "" {
+		required |= discordgo.PermissionCreatePublicThreads
+	}
+	return required
+}
+
+// pings reports whether a description mentions @everyone, @here or a role
+// by hand. Roles the bot creates are mentionable and don't need this.
+func pings(description string) bool {
+	return strings.Contains(description, "@everyone") ||
+		strings.Contains(description, "@here") ||
+		strings.Contains(description, "<@&")
+}
+
+// checkPermissions works out which target channels the bot is missing
+// permissions in, logs them per stream and guild, and keeps them for
+// /paintbot status.
+func checkPermissions(discord *discordgo.Session) []permissionProblem {
+	defer recoverLog("Checking channel permissions")
+
+	var problems []permissionProblem
+	for _, stream := range config.Streams {
+		type check struct {
+			target   discordChannel
+			required int64
+		}
+		var checks []check
+		for _, target := range stream.Channels {
+			checks = append(checks, check{target, requiredPermissions(stream, target)})
+		}
+		// VOD posts are never edited, so those channels only need to be
+		// postable.
+		for _, channelID := range stream.VodChannels {
+			checks = append(checks, check{discordChannel{ChannelID: channelID}, postPermissions})
+		}
+		for _, c := range checks {
+			target := c.target
+			missing := missingPermissions(discord, c.required, target.ChannelID)
+			if len(missing) == 0 {
+				continue
+			}
+			guildID := target.GuildID
+			if guildID == "" {
+				guildID = targetGuild(discord, target.ChannelID)
+			}
+			problems = append(problems, permissionProblem{
+				Stream:    stream.StreamName,
+				GuildID:   guildID,
+				ChannelID: target.ChannelID,
+				Missing:   missing,
+			})
+		}
+	}
+	sort.SliceStable(problems, func(a, b int) bool {
+		if problems[a].Stream != problems[b].Stream {
+			return problems[a].Stream < problems[b].Stream
+		}
+		return problems[a].GuildID < problems[b].GuildID
+	})
+
+	for _, problem := range problems {
+		log.Printf("%v in guild %v: missing %v in %v\n", problem.Stream, guildName(discord, problem.GuildID), strings.Join(problem.Missing, ", "), problem.ChannelID)
+	}
+	if len(problems) == 0 {
+		log.Println("Channel permissions look good")
+	}
+
+	permissionsMu.Lock()
+	permissionProblems = problems
+	permissionsMu.Unlock()
+	return problems
+}
+
+// guildPermissionProblems returns the last check's problems in guildID.
+func guildPermissionProblems(guildID string) []permissionProblem {
+	permissionsMu.Lock()
+	defer permissionsMu.Unlock()
+
+	var problems []permissionProblem
+	for _, problem := range permissionProblems {
+		if problem.GuildID == guildID {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// missingPermissions names the permissions in required the bot doesn't
+// have in channelID. A channel the bot can't look up at all is reported as
+// missing View Channel.
+func missingPermissions(discord *discordgo.Session, required int64, channelID string) []string {
+	granted, err := discord.UserChannelPermissions(discord.State.User.ID, channelID)
+	if err != nil {
+		log.Printf("Could not check permissions in %v: %v\n", channelID, err)
+		return []string{"View Channel"}
+	}
+
+	var missing []string
+	for _, p := range permissionNames {
+		if required&p.permission != 0 && granted&p.permission == 0 {
+			missing = append(missing, p.name)
+		}
+	}
+	return missing
+}
+
+func guildName(discord *discordgo.Session, guildID string) string {
+	if guildID == "" {
+		return "unknown"
+	}
+	if guild, err := discord.State.Guild(guildID); err == nil && guild.Name != "" {
+		return guild.Name
+	}
+	return guildID
+}
+
+// schedulePermissionCheck reruns checkPermissions shortly after the last of
+// a burst of channel, role or guild changes.
+func schedulePermissionCheck(discord *discordgo.Session) {
+	permissionsMu.Lock()
+	defer permissionsMu.Unlock()
+	if permissionTimer != nil {
+		permissionTimer.Stop()
+	}
+	permissionTimer = time.AfterFunc(10*time.Second, func() {
+		checkPermissions(discord)
+	})
+}
+
+// watchPermissions reschedules the permission check whenever something that
+// can change the bot's permissions happens in a guild.
+func watchPermissions(discord *discordgo.Session) {
+	discord.AddHandler(func(discord *discordgo.Session, _ *discordgo.GuildCreate) {
+		schedulePermissionCheck(discord)
+	})
+	// Updates to the bot's own member arrive without the privileged
+	// members intent, and are how role grants and removals show up.
+	discord.AddHandler(func(discord *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+		if m.User != nil && m.User.ID == discord.State.User.ID {
+			schedulePermissionCheck(discord)
+		}
+	})
+	discord.AddHandler(func(discord *discordgo.Session, _ *discordgo.ChannelCreate) {
+		schedulePermissionCheck(discord)
+	})
+	discord.AddHandler(func(discord *discordgo.Session, _ *discordgo.ChannelUpdate) {
+		schedulePermissionCheck(discord)
+	})
+	discord.AddHandler(func(discord *discordgo.Session, _ *discordgo.ChannelDelete) {
+		schedulePermissionCheck(discord)
+	})
+	discord.AddHandler(func(discord *discordgo.Session, _ *discordgo.GuildRoleUpdate) {
+		schedulePermissionCheck(discord)
+	})
+	discord.AddHandler(func(discord *discordgo.Session, _ *discordgo.GuildRoleDelete) {
+		schedulePermissionCheck(discord)
+	})
+}
+
+// formatPermissionProblems lists one guild's problems by stream for
+// /paintbot status.
+func formatPermissionProblems(problems []permissionProblem) string {
+	if len(problems) == 0 {
+		return "All target channels look good"
+	}
+	var lines []string
+	for _, problem := range problems {
+		lines = append(lines, fmt.Sprintf("%v <#%v>: %v", problem.Stream, problem.ChannelID, strings.Join(problem.Missing, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const presenceRotation = 30 * time.Second
+
+var (
+	presenceMu    sync.Mutex
+	presenceIndex int
+)
+
+type liveStreamer struct {
+	name string
+	url  string
+}
+
+// liveStreamers lists everyone live on Twitch or YouTube right now. It takes
+// each stream's lock in turn, so it mustn't be called with one held.
+func liveStreamers() []liveStreamer {
+	var live []liveStreamer
+	for _, stream := range config.Streams {
+		stream.mu.Lock()
+		if stream.Type == twitchType && stream.IsLive {
+			live = append(live, liveStreamer{stream.StreamName, "https://www.twitch.tv/" + stream.StreamName})
+		}
+		if stream.Type == youtubeType {
+			for _, broadcast := range stream.Broadcasts {
+				if broadcast.State == youtubeLive {
+					live = append(live, liveStreamer{stream.StreamName, "https://www.youtube.com/watch?v=" + broadcast.VideoID})
+					break
+				}
+			}
+		}
+		stream.mu.Unlock()
+	}
+	return live
+}
+
+// updatePresence sets the bot's activity from the streams that are live.
+// It's called on every online and offline transition, from its own
+// goroutine when the caller holds a stream's lock.
+func updatePresence() {
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+	if botSession == nil || config.Presence == presenceOff {
+		return
+	}
+
+	live := liveStreamers()
+	activity := &discordgo.Activity{Type: discordgo.ActivityTypeWatching}
+	switch {
+	case len(live) == 0:
+		activity.Name = "for streams"
+	case config.Presence == presenceRotate:
+		current := live[presenceIndex%len(live)]
+		activity.Type = discordgo.ActivityTypeStreaming
+		activity.Name = current.name
+		activity.URL = current.url
+	case len(live) == 1:
+		activity.Name = "1 stream live"
+	default:
+		activity.Name = fmt.Sprintf("%d streams live", len(live))
+	}
+
+	err := botSession.UpdateStatusComplex(discordgo.UpdateStatusData{
+		Activities: []*discordgo.Activity{activity},
+		Status:     string(discordgo.StatusOnline),
+	})
+	if err != nil {
+		log.Printf("Could not update presence: %v\n", err)
+	}
+}
+
+// rotatePresence moves on to the next live streamer periodically when the
+// presence is set to rotate.
+func rotatePresence() {
+	if config.Presence != presenceRotate {
+		return
+	}
+	for {
+		time.Sleep(presenceRotation)
+		presenceMu.Lock()
+		presenceIndex++
+		presenceMu.Unlock()
+		updatePresence()
+	}
+}
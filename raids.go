@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A raid between two tracked streamers arrives once for each side's
+// subscription, so recently posted raids are remembered for a short while.
+const raidDedupeWindow = 5 * time.Minute
+
+var (
+	raidsMu     sync.Mutex
+	recentRaids = make(map[string]time.Time)
+)
+
+func handleRaid(event map[string]any) {
+	from, _ := event["from_broadcaster_user_name"].(string)
+	fromLogin, _ := event["from_broadcaster_user_login"].(string)
+	to, _ := event["to_broadcaster_user_name"].(string)
+	toLogin, _ := event["to_broadcaster_user_login"].(string)
+	viewers, _ := event["viewers"].(float64)
+	log.Printf("Raid from %v to %v with %v viewers\n", from, to, viewers)
+
+	if config.Raids.TrackedOnly && (findChannel(fromLogin, twitchType) == nil || findChannel(toLogin, twitchType) == nil) {
+		return
+	}
+	if seenRaid(fromLogin + ">" + toLogin) {
+		log.Println("Raid already posted, ignoring notification")
+		return
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title: fmt.Sprintf("%v raided %v with %d viewers", from, to, int(viewers)),
+		URL:   "https://www.twitch.tv/" + toLogin,
+		Color: raidColour(toLogin),
+	}
+	postToRaidChannels(embed)
+}
+
+func handleShoutout(event map[string]any) {
+	from, _ := event["broadcaster_user_name"].(string)
+	to, _ := event["to_broadcaster_user_name"].(string)
+	toLogin, _ := event["to_broadcaster_user_login"].(string)
+	viewers, _ := event["viewer_count"].(float64)
+	log.Printf("Shoutout from %v to %v\n", from, to)
+
+	if config.Raids.TrackedOnly && findChannel(toLogin, twitchType) == nil {
+		return
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title: fmt.Sprintf("%v gave %v a shoutout in front of %d viewers", from, to, int(viewers)),
+		URL:   "https://www.twitch.tv/" + toLogin,
+		Color: raidColour(toLogin),
+	}
+	postToRaidChannels(embed)
+}
+
+func seenRaid(key string) bool {
+	raidsMu.Lock()
+	defer raidsMu.Unlock()
+
+	now := time.Now()
+	for k, at := range recentRaids {
+		if now.Sub(at) > raidDedupeWindow {
+			delete(recentRaids, k)
+		}
+	}
+	if _, ok := recentRaids[key]; ok {
+		return true
+	}
+	recentRaids[key] = now
+	return false
+}
+
+// raidColour uses the raided streamer's highlight colour when we track them.
+func raidColour(login string) int {
+	if channel := findChannel(login, twitchType); channel != nil {
+		return int(channel.HighlightColour)
+	}
+	return 0
+}
+
+func postToRaidChannels(embed *discordgo.MessageEmbed) {
+	if len(config.Raids.Channels) == 0 {
+		return
+	}
+	discord := createDiscordSession()
+	defer discord.Close()
+
+	for _, channelID := range config.Raids.Channels {
+		if _, err := discord.ChannelMessageSendEmbed(channelID, embed); err != nil {
+			log.Printf("%v did not send: %v\n", channelID, err)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const roleButtonPrefix = "paintbot_role:"
+
+// setupNotificationRoles makes sure every target with notify_role, on the
+// stream or the target itself, has a role in its guild, recreating any that
+// have been deleted, then posts or refreshes the role menus.
+func setupNotificationRoles(discord *discordgo.Session) {
+	defer recoverLog("Setting up notification roles")
+
+	guildRoles := make(map[string]map[string]bool)
+	for _, stream := range config.Streams {
+		stream.mu.Lock()
+		roles := make(map[string]string)
+		for i := range stream.Channels {
+			target := &stream.Channels[i]
+			if !wantsRole(stream, *target) {
+				continue
+			}
+			guildID := target.GuildID
+			if guildID == "" {
+				guildID = targetGuild(discord, target.ChannelID)
+			}
+			if guildID == "" {
+				continue
+			}
+			if _, ok := guildRoles[guildID]; !ok {
+				guildRoles[guildID] = existingRoles(discord, guildID)
+			}
+
+			// Targets in the same guild share one role.
+			if roleID, ok := roles[guildID]; ok {
+				target.RoleID = roleID
+				continue
+			}
+			if target.RoleID == "" || !guildRoles[guildID][target.RoleID] {
+				roleID, err := createNotificationRole(discord, guildID, stream, *target)
+				if err != nil {
+					log.Printf("Could not create role for %v in %v: %v\n", stream.StreamName, guildID, err)
+					continue
+				}
+				guildRoles[guildID][roleID] = true
+				target.RoleID = roleID
+			}
+			roles[guildID] = target.RoleID
+		}
+		stream.mu.Unlock()
+	}
+	writeConfig()
+
+	configMu.Lock()
+	for i := range config.RoleMenus {
+		postRoleMenu(discord, &config.RoleMenus[i])
+	}
+	configMu.Unlock()
+	writeConfig()
+}
+
+// handleRoleDelete recreates a notification role someone deleted and
+// refreshes the role menus so their buttons toggle the new role.
+func handleRoleDelete(discord *discordgo.Session, d *discordgo.GuildRoleDelete) {
+	defer recoverLog("Recreating role " + d.RoleID)
+
+	recreated := false
+	for _, stream := range config.Streams {
+		stream.mu.Lock()
+		newRoleID := ""
+		for i := range stream.Channels {
+			target := &stream.Channels[i]
+			if target.RoleID != d.RoleID || !wantsRole(stream, *target) {
+				continue
+			}
+			// Targets in the same guild share the role, so make one.
+			if newRoleID == "" {
+				roleID, err := createNotificationRole(discord, d.GuildID, stream, *target)
+				if err != nil {
+					log.Printf("Could not recreate role for %v in %v: %v\n", stream.StreamName, d.GuildID, err)
+					break
+				}
+				newRoleID = roleID
+			}
+			target.RoleID = newRoleID
+		}
+		stream.mu.Unlock()
+		if newRoleID != "" {
+			recreated = true
+		}
+	}
+	if !recreated {
+		return
+	}
+	writeConfig()
+
+	configMu.Lock()
+	for i := range config.RoleMenus {
+		if targetGuild(discord, config.RoleMenus[i].ChannelID) == d.GuildID {
+			postRoleMenu(discord, &config.RoleMenus[i])
+		}
+	}
+	configMu.Unlock()
+	writeConfig()
+}
+
+func existingRoles(discord *discordgo.Session, guildID string) map[string]bool {
+	roles := make(map[string]bool)
+	guildRoles, err := discord.GuildRoles(guildID)
+	if err != nil {
+		log.Printf("Could not list roles in %v: %v\n", guildID, err)
+		return roles
+	}
+	for _, role := range guildRoles {
+		roles[role.ID] = true
+	}
+	return roles
+}
+
+func createNotificationRole(discord *discordgo.Session, guildID string, stream *streamInfo, target discordChannel) (string, error) {
+	mentionable := true
+	colour := int(stream.HighlightColour)
+	if target.ColourString != "" {
+		colour = int(target.HighlightColour)
+	}
+	var permissions int64
+	role, err := discord.GuildRoleCreate(guildID, &discordgo.RoleParams{
+		Name:        stream.StreamName + " notifications",
+		Color:       &colour,
+		Mentionable: &mentionable,
+		Permissions: &permissions,
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Created role %v for %v in %v\n", role.ID, stream.StreamName, guildID)
+	return role.ID, nil
+}
+
+// roleMenuPage is how many buttons fit in one message: five to a row, five
+// rows to a message.
+const roleMenuPage = 25
+
+// postRoleMenu sends the menu message, or edits it if it's already there,
+// with a toggle button for each stream that has a role in the menu's guild.
+// Buttons that don't fit carry on in more messages below it.
+func postRoleMenu(discord *discordgo.Session, menu *roleMenu) {
+	guildID := targetGuild(discord, menu.ChannelID)
+	if guildID == "" {
+		return
+	}
+
+	var buttons []discordgo.MessageComponent
+	for _, stream := range config.Streams {
+		roleID := streamRole(discord, stream, guildID)
+		if roleID == "" {
+			continue
+		}
+		buttons = append(buttons, discordgo.Button{
+			Label:    stream.StreamName,
+			Style:    discordgo.SecondaryButton,
+			CustomID: roleButtonPrefix + roleID,
+		})
+	}
+
+	content := menu.Title
+	if content == "" {
+		content = "Pick the streams you want to be pinged for:"
+	}
+
+	pages := (len(buttons) + roleMenuPage - 1) / roleMenuPage
+	if pages == 0 {
+		pages = 1
+	}
+	for page := 0; page < pages; page++ {
+		start := page * roleMenuPage
+		end := start + roleMenuPage
+		if end > len(buttons) {
+			end = len(buttons)
+		}
+		rows := buttonRows(buttons[start:end])
+		if page == 0 {
+			menu.MessageID = postMenuMessage(discord, menu.ChannelID, menu.MessageID, content, rows)
+			continue
+		}
+		if len(menu.MoreMessageIDs) < page {
+			menu.MoreMessageIDs = append(menu.MoreMessageIDs, "")
+		}
+		menu.MoreMessageIDs[page-1] = postMenuMessage(discord, menu.ChannelID, menu.MoreMessageIDs[page-1], "More streams:", rows)
+	}
+
+	// Remove continuation messages the menu has outgrown.
+	for _, messageID := range menu.MoreMessageIDs[pages-1:] {
+		if messageID == "" {
+			continue
+		}
+		if err := discord.ChannelMessageDelete(menu.ChannelID, messageID); err != nil && !isNotFound(err) {
+			log.Printf("Could not delete role menu %v: %v\n", messageID, err)
+		}
+	}
+	menu.MoreMessageIDs = menu.MoreMessageIDs[:pages-1]
+	if len(menu.MoreMessageIDs) == 0 {
+		menu.MoreMessageIDs = nil
+	}
+}
+
+// buttonRows lays buttons out five to a row.
+func buttonRows(buttons []discordgo.MessageComponent) []discordgo.MessageComponent {
+	rows := []discordgo.MessageComponent{}
+	for start := 0; start < len(buttons); start += 5 {
+		end := start + 5
+		if end > len(buttons) {
+			end = len(buttons)
+		}
+		rows = append(rows, discordgo.ActionsRow{Components: buttons[start:end]})
+	}
+	return rows
+}
+
+// postMenuMessage edits a role menu message, or sends it if it isn't there,
+// and returns its id. The old id is kept if Discord can't be reached.
+func postMenuMessage(discord *discordgo.Session, channelID string, messageID string, content string, rows []discordgo.MessageComponent) string {
+	if messageID != "" {
+		edit := discordgo.NewMessageEdit(channelID, messageID).SetContent(content)
+		edit.Components = rows
+		edit.Embeds = []*discordgo.MessageEmbed{}
+		if _, err := discord.ChannelMessageEditComplex(edit); err == nil {
+			return messageID
+		} else if !isNotFound(err) {
+			log.Printf("Could not edit role menu %v: %v\n", messageID, err)
+			return messageID
+		}
+	}
+
+	msg, err := discord.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:    content,
+		Components: rows,
+	})
+	if err != nil {
+		log.Printf("Could not send role menu to %v: %v\n", channelID, err)
+		return messageID
+	}
+	return msg.ID
+}
+
+// streamRole returns the stream's notification role in a guild.
+func streamRole(discord *discordgo.Session, stream *streamInfo, guildID string) string {
+	for _, target := range stream.Channels {
+		if wantsRole(stream, target) && target.RoleID != "" && targetGuild(discord, target.ChannelID) == guildID {
+			return target.RoleID
+		}
+	}
+	return ""
+}
+
+// handleRoleButton toggles a notification role for the member who pressed a
+// role menu button.
+func handleRoleButton(discord *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent || i.Member == nil {
+		return
+	}
+	customID := i.MessageComponentData().CustomID
+	if !strings.HasPrefix(customID, roleButtonPrefix) {
+		return
+	}
+	roleID := strings.TrimPrefix(customID, roleButtonPrefix)
+	stream := roleStream(roleID)
+	if stream == nil {
+		respondEphemeral(discord, i, "That stream is no longer tracked.")
+		return
+	}
+
+	hasRole := false
+	for _, memberRole := range i.Member.Roles {
+		if memberRole == roleID {
+			hasRole = true
+			break
+		}
+	}
+
+	var err error
+	var reply string
+	if hasRole {
+		err = discord.GuildMemberRoleRemove(i.GuildID, i.Member.User.ID, roleID)
+		reply = "You will no longer be pinged when " + stream.StreamName + " goes live."
+	} else {
+		err = discord.GuildMemberRoleAdd(i.GuildID, i.Member.User.ID, roleID)
+		reply = "You will be pinged when " + stream.StreamName + " goes live."
+	}
+	if err != nil {
+		log.Printf("Could not toggle role %v for %v: %v\n", roleID, i.Member.User.ID, err)
+		reply = "Something went wrong! Please try again."
+	}
+	respondEphemeral(discord, i, reply)
+}
+
+func roleStream(roleID string) *streamInfo {
+	for _, stream := range config.Streams {
+		for _, target := range stream.Channels {
+			if wantsRole(stream, target) && target.RoleID == roleID {
+				return stream
+			}
+		}
+	}
+	return nil
+}
+
+func respondEphemeral(discord *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	err := discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Printf("Could not respond to interaction: %v\n", err)
+	}
+}
+
+// roleMention is the mention to put in front of a go-live post for target.
+func roleMention(stream *streamInfo, target discordChannel) string {
+	if !wantsRole(stream, target) || target.RoleID == "" {
+		return ""
+	}
+	return "<@&" + target.RoleID + "> "
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Twitch segments don't need an end time but external Discord events do.
+const defaultSegmentLength = 3 * time.Hour
+
+// syncSchedules keeps Discord scheduled events in line with each opted-in
+// streamer's Twitch schedule.
+func syncSchedules() {
+	interval, err := time.ParseDuration(config.ScheduleInterval)
+	if err != nil {
+		log.Printf("Invalid schedule_interval: %v\n", err)
+		return
+	}
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+
+	for {
+		discord := createDiscordSession()
+		for _, stream := range config.Streams {
+			if stream.Type == twitchType && stream.SyncSchedule {
+				syncSchedule(discord, stream)
+			}
+		}
+		discord.Close()
+		writeConfig()
+		time.Sleep(interval)
+	}
+}
+
+// syncSchedule creates, updates and cancels the stream's Discord events so
+// that each upcoming segment has exactly one event per guild. Mappings are
+// kept in stream.ScheduledEvents so running it again changes nothing.
+func syncSchedule(discord *discordgo.Session, stream *streamInfo) {
+	defer recoverLog("Syncing schedule for " + stream.StreamName)
+
+	schedule, err := getTwitchSchedule(stream.UserId)
+	if err != nil {
+		// An empty schedule would cancel every event we created.
+		log.Printf("Could not get schedule for %v: %v\n", stream.StreamName, err)
+		return
+	}
+	now := time.Now()
+
+	wanted := make(map[string]twitchScheduleSegment)
+	for _, segment := range schedule.Segments {
+		start, end, ok := segmentTimes(segment)
+		if !ok || !start.After(now) {
+			continue
+		}
+		if segment.CanceledUntil != "" {
+			continue
+		}
+		if onVacation(schedule, start, end) {
+			continue
+		}
+		wanted[segment.ID] = segment
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	guilds, complete := streamGuilds(discord, stream)
+	var kept []scheduledEvent
+	for _, event := range stream.ScheduledEvents {
+		segment, ok := wanted[event.SegmentID]
+		switch {
+		case ok && guilds[event.GuildID]:
+			if updated, ok := upsertEvent(discord, stream, segment, event); ok {
+				kept = append(kept, updated)
+			}
+		case ok && !complete:
+			// The guild may be one we couldn't look up, so leave its
+			// event alone rather than cancel it.
+			kept = append(kept, event)
+		case time.Unix(event.Start, 0).After(now):
+			// Cancelled, on vacation, or no longer posted to this guild.
+			log.Printf("Cancelling scheduled event %v for %v\n", event.EventID, stream.StreamName)
+			if err := discord.GuildScheduledEventDelete(event.GuildID, event.EventID); err != nil && !isNotFound(err) {
+				log.Printf("%v did not delete: %v\n", event.EventID, err)
+				kept = append(kept, event)
+			}
+		}
+		// Segments that have started are left for Discord to run.
+	}
+
+	for _, segment := range wanted {
+		for guildID := range guilds {
+			if hasScheduledEvent(kept, segment.ID, guildID) {
+				continue
+			}
+			if created, ok := upsertEvent(discord, stream, segment, scheduledEvent{SegmentID: segment.ID, GuildID: guildID}); ok {
+				kept = append(kept, created)
+			}
+		}
+	}
+	stream.ScheduledEvents = kept
+}
+
+// upsertEvent creates the event if it has no id yet, edits it if the
+// segment has changed, and recreates it if someone deleted it in Discord.
+func upsertEvent(discord *discordgo.Session, stream *streamInfo, segment twitchScheduleSegment, event scheduledEvent) (scheduledEvent, bool) {
+	start, end, _ := segmentTimes(segment)
+	name := stream.StreamName + ": " + segment.Title
+	if segment.Title == "" {
+		name = stream.StreamName + " is live"
+	}
+	if len([]rune(name)) > 100 {
+		name = string([]rune(name)[:100])
+	}
+
+	if event.EventID != "" && event.Name == name && event.Start == start.Unix() && event.End == end.Unix() {
+		return event, true
+	}
+
+	description := "https://www.twitch.tv/" + stream.StreamName
+	if segment.Category != nil && segment.Category.Name != "" {
+		description = segment.Category.Name + "\n" + description
+	}
+	params := &discordgo.GuildScheduledEventParams{
+		Name:               name,
+		Description:        description,
+		ScheduledStartTime: &start,
+		ScheduledEndTime:   &end,
+		PrivacyLevel:       discordgo.GuildScheduledEventPrivacyLevelGuildOnly,
+		EntityType:         discordgo.GuildScheduledEventEntityTypeExternal,
+		EntityMetadata: &discordgo.GuildScheduledEventEntityMetadata{
+			Location: "https://www.twitch.tv/" + stream.StreamName,
+		},
+	}
+
+	var result *discordgo.GuildScheduledEvent
+	var err error
+	if event.EventID != "" {
+		result, err = discord.GuildScheduledEventEdit(event.GuildID, event.EventID, params)
+		if isNotFound(err) {
+			event.EventID = ""
+		}
+	}
+	if event.EventID == "" {
+		result, err = discord.GuildScheduledEventCreate(event.GuildID, params)
+	}
+	if err != nil {
+		streamError(stream, "Could not sync scheduled event for %v in %v: %v\n", stream.StreamName, event.GuildID, err)
+		return event, event.EventID != ""
+	}
+
+	event.EventID = result.ID
+	event.Name = name
+	event.Start = start.Unix()
+	event.End = end.Unix()
+	return event, true
+}
+
+func segmentTimes(segment twitchScheduleSegment) (time.Time, time.Time, bool) {
+	start, err := time.Parse(time.RFC3339, segment.StartTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	end, err := time.Parse(time.RFC3339, segment.EndTime)
+	if err != nil || !end.After(start) {
+		end = start.Add(defaultSegmentLength)
+	}
+	return start, end, true
+}
+
+func onVacation(schedule twitchSchedule, start time.Time, end time.Time) bool {
+	if schedule.Vacation == nil {
+		return false
+	}
+	vacationStart, err1 := time.Parse(time.RFC3339, schedule.Vacation.StartTime)
+	vacationEnd, err2 := time.Parse(time.RFC3339, schedule.Vacation.EndTime)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return start.Before(vacationEnd) && end.After(vacationStart)
+}
+
+// streamGuilds returns the guilds a stream's Discord channels belong to. It
+// reports false, and records an error for /paintbot status, if any channel
+// couldn't be looked up. The caller must hold stream.mu.
+func streamGuilds(discord *discordgo.Session, stream *streamInfo) (map[string]bool, bool) {
+	guilds := make(map[string]bool)
+	complete := true
+	for _, target := range stream.Channels {
+		guildID := target.GuildID
+		if guildID == "" {
+			guildID = targetGuild(discord, target.ChannelID)
+		}
+		if guildID == "" {
+			streamError(stream, "Could not find the guild of %v to sync %v's schedule\n", target.ChannelID, stream.StreamName)
+			complete = false
+			continue
+		}
+		guilds[guildID] = true
+	}
+	return guilds, complete
+}
+
+func hasScheduledEvent(events []scheduledEvent, segmentID string, guildID string) bool {
+	for _, event := range events {
+		if event.SegmentID == segmentID && event.GuildID == guildID {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	restErr, ok := err.(*discordgo.RESTError)
+	return ok && restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sessionStore persists finished (and resumed) stream sessions. Swap
+// sessions for an in-memory store in tests.
+type sessionStore interface {
+	saveSession(session *streamSession) error
+	loadSessions(userId string) ([]*streamSession, error)
+}
+
+var sessions sessionStore = &fileSessionStore{dir: "sessions", keep: 200}
+
+// fileSessionStore keeps each stream's sessions in its own JSON file under
+// dir, named after the Twitch user id, and only the latest keep of them.
+// Sessions are keyed by start time so saving a session twice replaces it.
+type fileSessionStore struct {
+	dir  string
+	keep int
+	mu   sync.Mutex
+}
+
+func (s *fileSessionStore) saveSession(session *streamSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.read(session.UserID)
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i, existing := range all {
+		if existing.StartedAt == session.StartedAt {
+			all[i] = session
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		all = append(all, session)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].StartedAt < all[j].StartedAt
+	})
+	if s.keep > 0 && len(all) > s.keep {
+		all = all[len(all)-s.keep:]
+	}
+
+	bytes, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	path := s.path(session.UserID)
+	if err := ioutil.WriteFile(path+".tmp", bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *fileSessionStore) loadSessions(userId string) ([]*streamSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(userId)
+}
+
+func (s *fileSessionStore) path(userId string) string {
+	return filepath.Join(s.dir, filepath.Base(userId)+".json")
+}
+
+func (s *fileSessionStore) read(userId string) ([]*streamSession, error) {
+	content, err := ioutil.ReadFile(s.path(userId))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var all []*streamSession
+	err = json.Unmarshal(content, &all)
+	return all, err
+}
+
+// startSession begins a new session. Message ids from the previous session
+// are cleared so nothing edits them by mistake if this one isn't announced.
+func startSession(channel *streamInfo, streamId string, streamType string, startedAt time.Time) {
+	channel.Session = &streamSession{
+		StreamID:   streamId,
+		UserID:     channel.UserId,
+		StreamName: channel.StreamName,
+		StreamType: streamType,
+		StartedAt:  startedAt.Unix(),
+	}
+	for i := range channel.Channels {
+		channel.Channels[i].MessageID = ""
+	}
+	recordChange(channel)
+}
+
+// recordChange adds the stream's current title and category to the session
+// timeline if either has changed since the last entry.
+func recordChange(channel *streamInfo) {
+	session := channel.Session
+	if session == nil || session.EndedAt != 0 {
+		return
+	}
+	if last := session.lastChange(); last != nil && last.Title == channel.Title && last.CategoryID == channel.Category {
+		return
+	}
+	session.Changes = append(session.Changes, sessionChange{
+		At:         time.Now().Unix(),
+		Title:      channel.Title,
+		CategoryID: channel.Category,
+	})
+}
+
+func endSession(channel *streamInfo, endedAt time.Time) {
+	session := channel.Session
+	if session == nil || session.EndedAt != 0 {
+		return
+	}
+	session.EndedAt = endedAt.Unix()
+	if err := sessions.saveSession(session.forStore()); err != nil {
+		streamError(channel, "Could not save session for %v: %v\n", channel.StreamName, err)
+	}
+}
+
+// resumeSession reopens the session that ended at LastOffline when the
+// stream comes back within offline_time, rather than starting a new one.
+// It reports false if there is no session to resume.
+func resumeSession(channel *streamInfo, streamId string, onlineAt time.Time) bool {
+	session := channel.Session
+	if session == nil || session.EndedAt == 0 {
+		return false
+	}
+	session.Reconnects = append(session.Reconnects, reconnect{
+		OfflineAt: session.EndedAt,
+		OnlineAt:  onlineAt.Unix(),
+		StreamID:  streamId,
+	})
+	session.EndedAt = 0
+	restoreSamples(session)
+	recordChange(channel)
+	if err := sessions.saveSession(session.forStore()); err != nil {
+		streamError(channel, "Could not save session for %v: %v\n", channel.StreamName, err)
+	}
+	return true
+}
+
+// restoreSamples reloads a session's samples from the store after a
+// restart, so the summary and later saves don't drop them.
+func restoreSamples(session *streamSession) {
+	if len(session.samples) > 0 || session.SampleCount == 0 {
+		return
+	}
+	stored, err := sessions.loadSessions(session.UserID)
+	if err != nil {
+		return
+	}
+	for _, s := range stored {
+		if s.StartedAt == session.StartedAt {
+			session.samples = s.Samples
+			return
+		}
+	}
+}
+
+func (s *streamSession) lastChange() *sessionChange {
+	if len(s.Changes) == 0 {
+		return nil
+	}
+	return &s.Changes[len(s.Changes)-1]
+}
+
+// games returns the category ids played during the session, in order and
+// without consecutive repeats.
+func (s *streamSession) games() []string {
+	var games []string
+	for _, change := range s.Changes {
+		if change.CategoryID == "" {
+			continue
+		}
+		if len(games) > 0 && games[len(games)-1] == change.CategoryID {
+			continue
+		}
+		games = append(games, change.CategoryID)
+	}
+	return games
+}
+
+func (s *streamSession) duration() time.Duration {
+	end := s.EndedAt
+	if end == 0 {
+		end = time.Now().Unix()
+	}
+	return time.Unix(end, 0).Sub(time.Unix(s.StartedAt, 0))
+}
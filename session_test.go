@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFileSessionStoreRetention(t *testing.T) {
+	store := &fileSessionStore{dir: t.TempDir(), keep: 3}
+
+	for started := int64(1); started <= 5; started++ {
+		if err := store.saveSession(&streamSession{UserID: "1", StartedAt: started}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Saving a session again replaces it rather than adding another.
+	if err := store.saveSession(&streamSession{UserID: "1", StartedAt: 5, EndedAt: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.saveSession(&streamSession{UserID: "2", StartedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.loadSessions("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].StartedAt != 3 || got[2].EndedAt != 9 {
+		t.Errorf("sessions for 1: %+v", got)
+	}
+	if other, _ := store.loadSessions("2"); len(other) != 1 {
+		t.Errorf("sessions for 2: %+v", other)
+	}
+}
+
+func TestSessionSamplesStayOutOfConfig(t *testing.T) {
+	session := &streamSession{UserID: "1", StartedAt: 1}
+	for _, viewers := range []int{10, 30, 20} {
+		session.addSample(viewerSample{Viewers: viewers})
+	}
+
+	if peak, average := session.viewerStats(); peak != 30 || average != 20 {
+		t.Errorf("viewerStats = %d, %d, want 30, 20", peak, average)
+	}
+	if current, ok := session.currentViewers(); !ok || current != 20 {
+		t.Errorf("currentViewers = %d, %v", current, ok)
+	}
+	if len(session.Samples) != 0 {
+		t.Error("samples would be written to cfg.txt")
+	}
+	if stored := session.forStore(); len(stored.Samples) != 3 {
+		t.Errorf("store copy has %d samples, want 3", len(stored.Samples))
+	}
+}
+
+func TestMigrateSamples(t *testing.T) {
+	session := &streamSession{Samples: []viewerSample{{Viewers: 5}, {Viewers: 15}}}
+	session.migrateSamples()
+	if session.SampleCount != 2 || session.PeakViewers != 15 || len(session.Samples) != 0 {
+		t.Errorf("after migrating: %+v", session)
+	}
+}
+
+func TestSamplesSurviveRestart(t *testing.T) {
+	old := sessions
+	sessions = &fileSessionStore{dir: t.TempDir()}
+	t.Cleanup(func() { sessions = old })
+
+	live := &streamSession{UserID: "1", StartedAt: 1}
+	live.addSample(viewerSample{At: 10, Viewers: 10})
+	live.addSample(viewerSample{At: 20, Viewers: 30})
+	if err := sessions.saveSession(live.forStore()); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart only the running figures come back from cfg.txt.
+	loaded := *live
+	loaded.samples = nil
+	restoreSamples(&loaded)
+	if len(loaded.samples) != 2 {
+		t.Fatalf("restored %d samples, want 2", len(loaded.samples))
+	}
+	loaded.addSample(viewerSample{At: 30, Viewers: 20})
+	if stored := loaded.forStore(); len(stored.Samples) != int(stored.SampleCount) {
+		t.Errorf("store copy has %d samples for a count of %d", len(stored.Samples), stored.SampleCount)
+	}
+}
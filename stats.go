@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const helixBatchSize = 100
+
+var (
+	statsMu      sync.Mutex
+	statsRunning bool
+)
+
+// startStatsPoller starts sampling viewer counts if it isn't already
+// running. The poller stops by itself once no tracked stream is live, so it
+// is safe to call on every stream.online.
+func startStatsPoller() {
+	if config.StatsInterval == "" {
+		return
+	}
+	interval, err := time.ParseDuration(config.StatsInterval)
+	if err != nil {
+		log.Printf("Invalid stats_interval: %v\n", err)
+		return
+	}
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if statsRunning {
+		return
+	}
+	statsRunning = true
+	go pollStats(interval)
+}
+
+func pollStats(interval time.Duration) {
+	log.Println("Starting stats poller")
+	for {
+		time.Sleep(interval)
+
+		statsMu.Lock()
+		live := liveTwitchStreams()
+		if len(live) == 0 {
+			statsRunning = false
+			statsMu.Unlock()
+			log.Println("No streams live, stopping stats poller")
+			return
+		}
+		statsMu.Unlock()
+
+		sampleStreams(live)
+	}
+}
+
+func liveTwitchStreams() []*streamInfo {
+	var live []*streamInfo
+	for _, stream := range config.Streams {
+		if stream.Type != twitchType {
+			continue
+		}
+		stream.mu.Lock()
+		if stream.IsLive {
+			live = append(live, stream)
+		}
+		stream.mu.Unlock()
+	}
+	return live
+}
+
+// sampleStreams records a viewer sample for each of the given streams,
+// fetching them from /helix/streams in batches. The sessions are saved to
+// the session store as they go, so a restart mid-stream keeps the samples.
+func sampleStreams(live []*streamInfo) {
+	defer recoverLog("Sampling stream stats")
+
+	byUser := make(map[string]*streamInfo, len(live))
+	var userIds []string
+	for _, stream := range live {
+		byUser[stream.UserId] = stream
+		userIds = append(userIds, stream.UserId)
+	}
+
+	now := time.Now().Unix()
+	for start := 0; start < len(userIds); start += helixBatchSize {
+		end := start + helixBatchSize
+		if end > len(userIds) {
+			end = len(userIds)
+		}
+		streams, err := getTwitchStreams(userIds[start:end])
+		if err != nil {
+			log.Printf("Could not get streams for stats: %v\n", err)
+			continue
+		}
+		for _, twitchStream := range streams {
+			stream := byUser[twitchStream.UserID]
+			if stream == nil {
+				continue
+			}
+			stream.mu.Lock()
+			if !stream.IsLive || stream.Session == nil {
+				stream.mu.Unlock()
+				continue
+			}
+			stream.Session.addSample(viewerSample{
+				At:      now,
+				Viewers: twitchStream.ViewerCount,
+				GameID:  twitchStream.GameID,
+				Title:   twitchStream.Title,
+			})
+			stored := stream.Session.forStore()
+			stream.mu.Unlock()
+			if err := sessions.saveSession(stored); err != nil {
+				streamError(stream, "Could not save session for %v: %v\n", stream.StreamName, err)
+			}
+			if stream.ShowLiveStats {
+				go refreshNotification(stream)
+			}
+		}
+	}
+	writeConfig()
+}
+
+// addSample records a viewer sample and updates the running figures.
+func (s *streamSession) addSample(sample viewerSample) {
+	s.samples = append(s.samples, sample)
+	s.SampleCount++
+	s.ViewerSum += int64(sample.Viewers)
+	if sample.Viewers > s.PeakViewers {
+		s.PeakViewers = sample.Viewers
+	}
+	s.LastViewers = sample.Viewers
+}
+
+// migrateSamples moves samples persisted in cfg.txt by older versions into
+// memory and the running figures.
+func (s *streamSession) migrateSamples() {
+	if s.SampleCount > 0 {
+		return
+	}
+	samples := s.Samples
+	s.Samples = nil
+	for _, sample := range samples {
+		s.addSample(sample)
+	}
+}
+
+// forStore returns a copy of the session with its samples, for the session
+// store.
+func (s *streamSession) forStore() *streamSession {
+	stored := *s
+	stored.Samples = s.samples
+	return &stored
+}
+
+// viewerStats returns the peak and average viewer counts over a session's
+// samples.
+func (s *streamSession) viewerStats() (peak int, average int) {
+	if s.SampleCount == 0 {
+		return 0, 0
+	}
+	return s.PeakViewers, int(s.ViewerSum / int64(s.SampleCount))
+}
+
+func (s *streamSession) currentViewers() (int, bool) {
+	if s.SampleCount == 0 {
+		return 0, false
+	}
+	return s.LastViewers, true
+}
+
+func formatUptime(d time.Duration) string {
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
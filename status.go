@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var errorsMu sync.Mutex
+
+// streamError logs a failure for a stream and keeps it as the stream's last
+// error for /paintbot status.
+func streamError(stream *streamInfo, format string, args ...any) {
+	log.Printf(format, args...)
+
+	errorsMu.Lock()
+	stream.lastError = strings.TrimSpace(fmt.Sprintf(format, args...))
+	stream.lastErrorAt = time.Now()
+	errorsMu.Unlock()
+}
+
+func handleLive(discord *discordgo.Session, i *discordgo.InteractionCreate, subcommand *discordgo.ApplicationCommandInteractionDataOption) {
+	deferResponse(discord, i, false)
+
+	embed := &discordgo.MessageEmbed{Title: "Live now"}
+	for _, stream := range config.Streams {
+		if !streamInGuild(discord, stream, i.GuildID) {
+			continue
+		}
+		if stream.Type == twitchType && stream.IsLive {
+			value := "https://www.twitch.tv/" + stream.StreamName
+			if stream.Category != "" {
+				if game, err := getTwitchGame(stream.Category); err == nil && game != nil {
+					value = game.Name + "\n" + value
+				}
+			}
+			if stream.Session != nil {
+				value = "Up " + formatUptime(stream.Session.duration()) + " · " + value
+			}
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+				Name:  stream.StreamName + ": " + stream.Title,
+				Value: value,
+			})
+		}
+		if stream.Type == youtubeType {
+			for _, broadcast := range stream.Broadcasts {
+				if broadcast.State == youtubeLive {
+					embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+						Name:  stream.StreamName + " (YouTube)",
+						Value: "https://www.youtube.com/watch?v=" + broadcast.VideoID,
+					})
+				}
+			}
+		}
+	}
+	if len(embed.Fields) == 0 {
+		embed.Description = "Nobody is live right now."
+	}
+	if len(embed.Fields) > 25 {
+		embed.Fields = embed.Fields[:25]
+	}
+	respondEmbed(discord, i, embed)
+}
+
+func handleStatus(discord *discordgo.Session, i *discordgo.InteractionCreate, subcommand *discordgo.ApplicationCommandInteractionDataOption) {
+	if i.Member == nil || i.Member.Permissions&discordgo.PermissionManageServer == 0 {
+		respondEphemeral(discord, i, "You need Manage Server to see the bot's status.")
+		return
+	}
+
+	deferResponse(discord, i, true)
+
+	embed := &discordgo.MessageEmbed{Title: "PaintBot status"}
+	addField := func(name, value string) {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: name, Value: value})
+	}
+
+	addField("Twitch token", "Expires "+discordTime(twitchToken.Expiry))
+	addField("Discord gateway", "Heartbeat latency "+discord.HeartbeatLatency().Round(time.Millisecond).String())
+
+	if config.DetectionMode == detectionPoll {
+		addField("EventSub", "Polling mode, no subscriptions")
+	} else if subs, err := getSubscriptions(""); err != nil {
+		addField("EventSub", "Could not list subscriptions: "+err.Error())
+	} else {
+		counts := make(map[string]int)
+		for _, sub := range subs.Data {
+			counts[sub.Status]++
+		}
+		var statuses []string
+		for status, count := range counts {
+			statuses = append(statuses, fmt.Sprintf("%v: %d", status, count))
+		}
+		sort.Strings(statuses)
+		if len(statuses) == 0 {
+			statuses = append(statuses, "none")
+		}
+		addField("EventSub", fmt.Sprintf("%v\nCost %d of %d", strings.Join(statuses, "\n"), subs.TotalCost, subs.MaxTotalCost))
+	}
+
+	var leases []string
+	var problems []string
+	// Other guilds' streams and their errors aren't this guild's business.
+	var guildStreams []*streamInfo
+	for _, stream := range config.Streams {
+		if streamInGuild(discord, stream, i.GuildID) {
+			guildStreams = append(guildStreams, stream)
+		}
+	}
+	errorsMu.Lock()
+	for _, stream := range guildStreams {
+		if stream.Type == youtubeType {
+			lease := "not verified"
+			if stream.LeaseExpires > 0 {
+				lease = "expires " + discordTime(time.Unix(stream.LeaseExpires, 0))
+			}
+			leases = append(leases, stream.StreamName+": "+lease)
+		}
+		if stream.lastError != "" {
+			problems = append(problems, fmt.Sprintf("%v %v: %v", discordTime(stream.lastErrorAt), stream.StreamName, stream.lastError))
+		}
+	}
+	errorsMu.Unlock()
+
+	if len(leases) > 0 {
+		addField("WebSub leases", truncateField(strings.Join(leases, "\n")))
+	}
+	if len(problems) == 0 {
+		problems = append(problems, "No errors since start")
+	}
+	addField("Last errors", truncateField(strings.Join(problems, "\n")))
+	addField("Channel permissions", truncateField(formatPermissionProblems(guildPermissionProblems(i.GuildID))))
+
+	respondEmbed(discord, i, embed)
+}
+
+// deferResponse acknowledges a command that needs Twitch lookups before it
+// can answer, since Discord only waits three seconds for a response.
+func deferResponse(discord *discordgo.Session, i *discordgo.InteractionCreate, ephemeral bool) {
+	data := &discordgo.InteractionResponseData{}
+	if ephemeral {
+		data.Flags = discordgo.MessageFlagsEphemeral
+	}
+	err := discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: data,
+	})
+	if err != nil {
+		log.Printf("Could not respond to interaction: %v\n", err)
+	}
+}
+
+// respondEmbed fills in a deferred response.
+func respondEmbed(discord *discordgo.Session, i *discordgo.InteractionCreate, embed *discordgo.MessageEmbed) {
+	embeds := []*discordgo.MessageEmbed{embed}
+	if _, err := discord.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Embeds: &embeds}); err != nil {
+		log.Printf("Could not respond to interaction: %v\n", err)
+	}
+}
+
+func discordTime(t time.Time) string {
+	return fmt.Sprintf("<t:%d:R>", t.Unix())
+}
+
+// truncateField keeps a value within Discord's 1024 character field limit.
+func truncateField(value string) string {
+	if len(value) <= 1024 {
+		return value
+	}
+	return value[:1021] + "..."
+}
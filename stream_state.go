@@ -0,0 +1,263 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// streamState is where a Twitch stream is in its lifecycle. Every event for
+// a stream goes through transition, under the stream's mu, so the decision
+// to send or edit never depends on a flag another goroutine is about to
+// flip.
+//
+//	offline    --online-->  going_live  (announce)
+//	going_live --posted-->  live
+//	live       --update-->  live        (edit)
+//	live       --offline--> cooldown    (end)
+//	cooldown   --online-->  live        (resume, within offline_time)
+//	cooldown   --expires--> offline
+type streamState string
+
+const (
+	stateOffline   streamState = "offline"
+	stateGoingLive streamState = "going_live"
+	stateLive      streamState = "live"
+	stateCooldown  streamState = "cooldown"
+)
+
+type streamEventKind int
+
+const (
+	eventOnline streamEventKind = iota
+	eventOffline
+	eventUpdate
+)
+
+type streamEvent struct {
+	Kind       streamEventKind
+	StreamID   string
+	StreamType string
+	At         time.Time
+	Title      string
+	CategoryID string
+}
+
+type streamAction int
+
+const (
+	actionNone streamAction = iota
+	// actionAnnounce starts a session and sends new messages.
+	actionAnnounce
+	// actionRestart ends the current session and announces a new one, for
+	// when we missed the offline between two streams.
+	actionRestart
+	// actionResume carries on the previous session after a short drop,
+	// editing the original messages back to live.
+	actionResume
+	// actionEdit edits the existing messages.
+	actionEdit
+	// actionEnd ends the session and applies the offline_action.
+	actionEnd
+	// actionNoteOffline records an offline that arrived while the stream
+	// was offline, so an online delivered late for the same stream is
+	// recognised as stale.
+	actionNoteOffline
+)
+
+// currentState returns the stream's state with any expired cooldown
+// resolved to offline.
+func currentState(channel *streamInfo, now time.Time) streamState {
+	state := channel.State
+	if state == "" {
+		state = stateOffline
+		if channel.IsLive {
+			state = stateLive
+		}
+	}
+	if state == stateCooldown && (channel.DisableOffline || now.Unix()-channel.LastOffline > channel.OfflineTime) {
+		state = stateOffline
+	}
+	return state
+}
+
+// transition decides the next state and what to do about an event. It has
+// no side effects so every ordering of events can be checked in isolation.
+func transition(channel *streamInfo, ev streamEvent, now time.Time) (streamState, streamAction) {
+	state := currentState(channel, now)
+
+	switch ev.Kind {
+	case eventOnline:
+		if staleOnline(channel, ev, state) {
+			return state, actionNone
+		}
+		switch state {
+		case stateOffline:
+			return stateGoingLive, actionAnnounce
+		case stateCooldown:
+			if ev.At.Unix()-channel.LastOffline > channel.OfflineTime {
+				return stateGoingLive, actionAnnounce
+			}
+			return stateLive, actionResume
+		case stateGoingLive, stateLive:
+			if ev.StreamID != "" && channel.CurrentStreamID != "" && ev.StreamID != channel.CurrentStreamID {
+				return stateGoingLive, actionRestart
+			}
+			return state, actionNone
+		}
+
+	case eventOffline:
+		switch state {
+		case stateGoingLive, stateLive:
+			if channel.DisableOffline {
+				return stateOffline, actionEnd
+			}
+			return stateCooldown, actionEnd
+		case stateOffline:
+			return state, actionNoteOffline
+		}
+		// A repeated offline mustn't push the cooldown back.
+		return state, actionNone
+
+	case eventUpdate:
+		switch state {
+		case stateGoingLive, stateLive:
+			return state, actionEdit
+		}
+		return state, actionNone
+	}
+	return state, actionNone
+}
+
+// staleOnline reports whether an online is for a stream that has already
+// ended. Twitch doesn't guarantee delivery order, and offline times are when
+// we heard about them rather than when the stream ended, so streams are told
+// apart by id. An online whose offline we saw first is known by the stray
+// offline that arrived after it started.
+func staleOnline(channel *streamInfo, ev streamEvent, state streamState) bool {
+	if state != stateOffline && state != stateCooldown {
+		return false
+	}
+	if ev.StreamID != "" && ev.StreamID == channel.CurrentStreamID {
+		return true
+	}
+	return state == stateOffline && channel.StrayOffline > 0 && ev.At.Unix() < channel.StrayOffline
+}
+
+// applyEvent moves the stream to its next state and does the bookkeeping
+// for it, returning what handleStreamEvent should do about the event. It
+// doesn't talk to Discord or Helix.
+func applyEvent(channel *streamInfo, ev streamEvent, now time.Time) streamAction {
+	if ev.Kind == eventUpdate {
+		channel.Title = ev.Title
+		channel.Category = ev.CategoryID
+	}
+
+	next, action := transition(channel, ev, now)
+	log.Printf("%v: %v -> %v (action %d)\n", channel.StreamName, currentState(channel, now), next, action)
+	setState(channel, next)
+
+	switch action {
+	case actionAnnounce, actionRestart:
+		channel.CurrentStreamID = ev.StreamID
+		channel.StrayOffline = 0
+	case actionResume:
+		if ev.StreamID != "" {
+			channel.CurrentStreamID = ev.StreamID
+		}
+	case actionEnd:
+		channel.LastOffline = now.Unix()
+	case actionNoteOffline:
+		channel.StrayOffline = now.Unix()
+	}
+	return action
+}
+
+// completeEvent moves an announced stream from going_live to live once its
+// messages are out.
+func completeEvent(channel *streamInfo, action streamAction) {
+	if action == actionAnnounce || action == actionRestart {
+		setState(channel, stateLive)
+	}
+}
+
+// handleStreamEvent applies an event to a stream and carries out whatever
+// the transition calls for.
+func handleStreamEvent(channel *streamInfo, ev streamEvent) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	now := time.Now()
+	wasLive := channel.IsLive
+	action := applyEvent(channel, ev, now)
+	if channel.IsLive != wasLive {
+		go updatePresence()
+	}
+
+	switch action {
+	case actionRestart:
+		endSession(channel, ev.At)
+		endNotification(channel)
+		fallthrough
+	case actionAnnounce:
+		if len(channel.Title) == 0 {
+			twitchChannel, err := getTwitchChannel(channel.UserId)
+			if err != nil {
+				streamError(channel, "Could not get channel info for %v: %v\n", channel.StreamName, err)
+			}
+			channel.Title = twitchChannel.Title
+			channel.Category = twitchChannel.GameID
+		}
+		startSession(channel, ev.StreamID, ev.StreamType, ev.At)
+		if announces(channel, ev.StreamType) {
+			postNotification(channel, false)
+			if ev.StreamType != streamTypeRerun {
+				notifyFollowers(channel, &discordgo.MessageSend{
+					Content: channel.StreamName + " is live: " + channel.Title + "\nhttps://www.twitch.tv/" + channel.StreamName,
+				})
+			}
+		} else {
+			log.Printf("Not announcing %v stream for %v\n", ev.StreamType, channel.StreamName)
+		}
+		startStatsPoller()
+	case actionResume:
+		if !resumeSession(channel, ev.StreamID, ev.At) {
+			startSession(channel, ev.StreamID, ev.StreamType, ev.At)
+		}
+		if announces(channel, channel.Session.StreamType) {
+			postNotification(channel, true)
+		}
+		startStatsPoller()
+	case actionEdit:
+		recordChange(channel)
+		scheduleUpdate(channel)
+	case actionEnd:
+		endSession(channel, now)
+		endNotification(channel)
+	}
+	completeEvent(channel, action)
+	writeConfig()
+}
+
+// announces reports whether the stream's announce_types policy covers
+// streamType. An empty policy announces everything.
+func announces(channel *streamInfo, streamType string) bool {
+	if len(channel.AnnounceTypes) == 0 {
+		return true
+	}
+	if streamType == "" {
+		streamType = streamTypeLive
+	}
+	for _, announceType := range channel.AnnounceTypes {
+		if announceType == streamType {
+			return true
+		}
+	}
+	return false
+}
+
+func setState(channel *streamInfo, state streamState) {
+	channel.State = state
+	channel.IsLive = state == stateGoingLive || state == stateLive
+}
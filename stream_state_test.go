@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransitionOrderings(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+
+	type step struct {
+		kind streamEventKind
+		id   string
+		// at is when the event happened, now when it was delivered, both
+		// in seconds after base. Offline and update events happen when
+		// they are delivered.
+		at, now int64
+		action  streamAction
+		state   streamState
+	}
+	online := func(id string, at, now int64, action streamAction, state streamState) step {
+		return step{eventOnline, id, at, now, action, state}
+	}
+	offline := func(now int64, action streamAction, state streamState) step {
+		return step{eventOffline, "", now, now, action, state}
+	}
+	update := func(now int64, action streamAction, state streamState) step {
+		return step{eventUpdate, "", now, now, action, state}
+	}
+
+	tests := []struct {
+		name           string
+		disableOffline bool
+		steps          []step
+	}{
+		{"online update offline", false, []step{
+			online("a", 0, 0, actionAnnounce, stateLive),
+			update(10, actionEdit, stateLive),
+			offline(20, actionEnd, stateCooldown),
+		}},
+		{"online offline update", false, []step{
+			online("a", 0, 0, actionAnnounce, stateLive),
+			offline(20, actionEnd, stateCooldown),
+			update(30, actionNone, stateCooldown),
+		}},
+		{"update online offline", false, []step{
+			update(0, actionNone, stateOffline),
+			online("a", 0, 10, actionAnnounce, stateLive),
+			offline(20, actionEnd, stateCooldown),
+		}},
+		{"update offline late online", false, []step{
+			update(5, actionNone, stateOffline),
+			offline(20, actionNoteOffline, stateOffline),
+			online("a", 0, 30, actionNone, stateOffline),
+		}},
+		{"offline before its online", false, []step{
+			offline(20, actionNoteOffline, stateOffline),
+			online("a", 0, 30, actionNone, stateOffline),
+		}},
+		{"offline update late online", false, []step{
+			offline(20, actionNoteOffline, stateOffline),
+			update(25, actionNone, stateOffline),
+			online("a", 0, 30, actionNone, stateOffline),
+		}},
+		{"new stream after a stray offline", false, []step{
+			offline(20, actionNoteOffline, stateOffline),
+			online("a", 100, 100, actionAnnounce, stateLive),
+		}},
+		{"reconnect inside offline_time", false, []step{
+			online("a", 0, 0, actionAnnounce, stateLive),
+			offline(100, actionEnd, stateCooldown),
+			online("b", 200, 200, actionResume, stateLive),
+		}},
+		{"reconnect outside offline_time", false, []step{
+			online("a", 0, 0, actionAnnounce, stateLive),
+			offline(100, actionEnd, stateCooldown),
+			online("b", 1000, 1000, actionAnnounce, stateLive),
+		}},
+		{"reconnect with offline disabled", true, []step{
+			online("a", 0, 0, actionAnnounce, stateLive),
+			offline(100, actionEnd, stateOffline),
+			online("b", 200, 200, actionAnnounce, stateLive),
+		}},
+		{"stream id change without offline", false, []step{
+			online("a", 0, 0, actionAnnounce, stateLive),
+			online("b", 500, 500, actionRestart, stateLive),
+		}},
+		{"duplicate online", false, []step{
+			online("a", 0, 0, actionAnnounce, stateLive),
+			online("a", 0, 10, actionNone, stateLive),
+		}},
+		{"stale online after offline", false, []step{
+			online("a", 0, 0, actionAnnounce, stateLive),
+			offline(100, actionEnd, stateCooldown),
+			online("a", 50, 150, actionNone, stateCooldown),
+		}},
+		{"stale online after cooldown expires", false, []step{
+			online("a", 0, 0, actionAnnounce, stateLive),
+			offline(100, actionEnd, stateCooldown),
+			online("a", 50, 1000, actionNone, stateOffline),
+		}},
+		{"restart inside the offline delivery lag", false, []step{
+			online("a", 0, 0, actionAnnounce, stateLive),
+			offline(100, actionEnd, stateCooldown),
+			online("b", 90, 120, actionResume, stateLive),
+		}},
+		{"repeated offline doesn't extend cooldown", false, []step{
+			online("a", 0, 0, actionAnnounce, stateLive),
+			offline(100, actionEnd, stateCooldown),
+			offline(350, actionNone, stateCooldown),
+			online("b", 450, 450, actionAnnounce, stateLive),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channel := &streamInfo{OfflineTime: 300, DisableOffline: tt.disableOffline}
+			for i, s := range tt.steps {
+				now := base.Add(time.Duration(s.now) * time.Second)
+				ev := streamEvent{Kind: s.kind, StreamID: s.id, At: base.Add(time.Duration(s.at) * time.Second)}
+				action := applyEvent(channel, ev, now)
+				completeEvent(channel, action)
+				if action != s.action {
+					t.Errorf("step %d: action %d, want %d", i, action, s.action)
+				}
+				if state := currentState(channel, now); state != s.state {
+					t.Errorf("step %d: state %v, want %v", i, state, s.state)
+				}
+			}
+		})
+	}
+}
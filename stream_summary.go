@@ -0,0 +1,185 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func twitchEmbedAuthor(channel *streamInfo, user twitchUser) *discordgo.MessageEmbedAuthor {
+	return &discordgo.MessageEmbedAuthor{
+		URL:     "https://www.twitch.tv/" + channel.StreamName,
+		Name:    channel.StreamName,
+		IconURL: strings.Replace(strings.Replace(user.ProfileImage, "{width}", "70", 1), "{height}", "70", 1),
+	}
+}
+
+// endNotification updates a stream's live messages once it has gone
+// offline, according to the stream's offline_action. The caller must hold
+// channel.mu.
+func endNotification(channel *streamInfo) {
+	if channel.updateTimer != nil {
+		channel.updateTimer.Stop()
+		channel.updateTimer = nil
+	}
+
+	action := channel.OfflineAction
+	if action == "" {
+		action = offlineSummary
+	}
+
+	var vod *twitchVideo
+	if action == offlineSummary || len(channel.VodChannels) > 0 {
+		vod = findVod(channel)
+	}
+	if vod != nil {
+		postVods(channel, []twitchVideo{*vod})
+	}
+	archiveThreads(channel.Channels)
+
+	if action == offlineNone {
+		return
+	}
+
+	discord := createDiscordSession()
+	defer discord.Close()
+
+	if action == offlineDelete {
+		for i, target := range channel.Channels {
+			if target.MessageID == "" {
+				continue
+			}
+			if err := discord.ChannelMessageDelete(target.ChannelID, target.MessageID); err != nil {
+				streamError(channel, "%v did not delete: %v\n", target.MessageID, err)
+			}
+			channel.Channels[i].MessageID = ""
+		}
+		return
+	}
+
+	embed := summaryEmbed(channel, vod)
+	links := twitchButtonLinks(channel, vod)
+	for _, target := range channel.Channels {
+		if target.MessageID == "" {
+			continue
+		}
+		if err := editMessage(discord, target, target.MessageID, targetEmbed(target, embed), links); err != nil {
+			streamError(channel, "%v did not edit: %v\n", target.MessageID, err)
+		}
+	}
+}
+
+func summaryEmbed(channel *streamInfo, vod *twitchVideo) *discordgo.MessageEmbed {
+	user, err := getTwitchUser(channel.StreamName)
+	if err != nil {
+		log.Printf("Could not look up %v: %v\n", channel.StreamName, err)
+	}
+
+	var games []string
+	var gameIds []string
+	if channel.Session != nil {
+		gameIds = channel.Session.games()
+	}
+	for _, gameId := range gameIds {
+		if game, err := getTwitchGame(gameId); err == nil && game != nil {
+			games = append(games, game.Name)
+		}
+	}
+	if len(games) == 0 {
+		games = append(games, "N/A")
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Author:      twitchEmbedAuthor(channel, user),
+		Color:       int(channel.HighlightColour),
+		Title:       channel.Title,
+		URL:         "https://www.twitch.tv/" + channel.StreamName,
+		Description: "Stream ended",
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   "Games",
+				Value:  strings.Join(games, ", "),
+				Inline: true,
+			},
+		},
+	}
+	if user.OfflineImage != "" {
+		embed.Image = &discordgo.MessageEmbedImage{URL: user.OfflineImage}
+	}
+
+	if channel.Session != nil {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   "Duration",
+			Value:  channel.Session.duration().Round(time.Minute).String(),
+			Inline: true,
+		})
+	}
+
+	if channel.Session != nil && channel.Session.SampleCount > 0 {
+		peak, average := channel.Session.viewerStats()
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   "Peak viewers",
+			Value:  strconv.Itoa(peak),
+			Inline: true,
+		}, &discordgo.MessageEmbedField{
+			Name:   "Average viewers",
+			Value:  strconv.Itoa(average),
+			Inline: true,
+		})
+	}
+
+	if vod != nil {
+		embed.URL = vod.URL
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  "VOD",
+			Value: vod.URL,
+		})
+	}
+	return embed
+}
+
+// findVod returns the archive for the stream that just ended, if Twitch has
+// one. Archives carry the stream id; failing that, the newest archive created
+// around the session start is the one we want.
+func findVod(channel *streamInfo) *twitchVideo {
+	session := channel.Session
+	if session == nil {
+		return nil
+	}
+	videos, err := getTwitchVideos(channel.UserId, "archive")
+	if err != nil {
+		log.Printf("Could not get archives for %v: %v\n", channel.StreamName, err)
+		return nil
+	}
+	for i := range videos {
+		if session.StreamID != "" && videos[i].StreamID == session.StreamID {
+			return &videos[i]
+		}
+	}
+	for i := range videos {
+		created, err := time.Parse(time.RFC3339, videos[i].CreatedAt)
+		if err == nil && created.Unix() >= session.StartedAt-300 {
+			return &videos[i]
+		}
+	}
+	return nil
+}
+
+type streamStyle struct {
+	label  string
+	colour int
+	ping   bool
+}
+
+// streamStyles sets how each stream.online type is presented. Live streams
+// keep the stream's own highlight colour; reruns never ping.
+var streamStyles = map[string]streamStyle{
+	streamTypeLive:       {label: "🔴 Live now", ping: true},
+	streamTypePremiere:   {label: "🎬 Premiere", colour: 0xE91E63, ping: true},
+	streamTypeWatchParty: {label: "🍿 Watch party", colour: 0x9B59B6, ping: true},
+	streamTypePlaylist:   {label: "📼 Playlist", colour: 0x607D8B, ping: true},
+	streamTypeRerun:      {label: "🔁 Rerun", colour: 0x95A5A6},
+}
@@ -3,171 +3,237 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func getTwitchUser(userId string) twitchUser {
-	var users twitchUserJSON
+// helixError is a non-2xx response from the Helix API.
+type helixError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *helixError) Error() string {
+	return "helix returned " + e.Status + ": " + e.Body
+}
+
+// helixGet fetches path from the Helix API and decodes the response into v.
+func helixGet(path string, v any) error {
+	return helixRequest("GET", path, nil, v)
+}
 
-	log.Println(userId)
-	req, _ := http.NewRequest("GET", "https://api.twitch.tv/helix/users?login="+userId, nil)
+// helixRequest sends a Helix request with an optional JSON body and decodes
+// the response into v, unless v is nil.
+func helixRequest(method string, path string, body []byte, v any) error {
+	if err := validateToken(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, "https://api.twitch.tv/helix"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
 	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
 	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
 	req.Header.Add("Content-type", "application/json")
 
-	validateToken()
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = json.Unmarshal(body, &users)
-
-	if err != nil {
-		panic(err)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &helixError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(respBody)}
+	}
+	if v == nil {
+		return nil
 	}
+	return json.Unmarshal(respBody, v)
+}
 
-	log.Println(users)
-	return users.Users[0]
+func getTwitchUser(login string) (twitchUser, error) {
+	var users twitchUserJSON
+	if err := helixGet("/users?login="+login, &users); err != nil {
+		return twitchUser{}, err
+	}
+	if len(users.Users) == 0 {
+		return twitchUser{}, fmt.Errorf("no twitch user %v", login)
+	}
+	return users.Users[0], nil
 }
 
-func getTwitchChannel(userId string) twitchChannel {
+func getTwitchChannel(userId string) (twitchChannel, error) {
 	var channels twitchChannelJSON
-
-	req, _ := http.NewRequest("GET", "https://api.twitch.tv/helix/channels?broadcaster_id="+userId, nil)
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
-	req.Header.Add("Content-type", "application/json")
-
-	validateToken()
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
+	if err := helixGet("/channels?broadcaster_id="+userId, &channels); err != nil {
+		return twitchChannel{}, err
 	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
+	if len(channels.Channel) == 0 {
+		return twitchChannel{}, fmt.Errorf("no twitch channel for %v", userId)
 	}
-	err = json.Unmarshal(body, &channels)
+	return channels.Channel[0], nil
+}
 
-	if err != nil {
-		panic(err)
+func getTwitchChannels(userIds []string) ([]twitchChannel, error) {
+	var channels twitchChannelJSON
+	if err := helixGet("/channels?broadcaster_id="+strings.Join(userIds, "&broadcaster_id="), &channels); err != nil {
+		return nil, err
 	}
-
-	log.Println(channels)
-	return channels.Channel[0]
+	return channels.Channel, nil
 }
 
-func getTwitchGame(id string) *twitchGame {
+// getTwitchGame looks up a category. It returns nil without an error when
+// Twitch doesn't know the id.
+func getTwitchGame(id string) (*twitchGame, error) {
 	var g twitchGameJSON
+	if err := helixGet("/games?id="+id, &g); err != nil {
+		return nil, err
+	}
+	if len(g.Games) == 0 {
+		return nil, nil
+	}
+	return &g.Games[0], nil
+}
 
-	req, _ := http.NewRequest("GET", "https://api.twitch.tv/helix/games?id="+id, nil)
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
-	req.Header.Add("Content-type", "application/json")
+// twitchVideoPage is how many videos getTwitchVideos asks for.
+const twitchVideoPage = 20
 
-	validateToken()
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
+func getTwitchVideos(userId string, videoType string) ([]twitchVideo, error) {
+	var v twitchVideoJSON
+	if err := helixGet("/videos?first="+strconv.Itoa(twitchVideoPage)+"&user_id="+userId+"&type="+videoType, &v); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return v.Videos, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
+// getTwitchStreams returns the live streams among userIds. Helix accepts up
+// to 100 ids per request so callers should batch accordingly.
+func getTwitchStreams(userIds []string) ([]twitchStream, error) {
+	var st twitchStreamJSON
+	if err := helixGet("/streams?first=100&user_id="+strings.Join(userIds, "&user_id="), &st); err != nil {
+		return nil, err
 	}
+	return st.Streams, nil
+}
 
-	err = json.Unmarshal(body, &g)
-
-	if err != nil {
-		panic(err)
+// twitchSubscriptionsFor lists the EventSub subscriptions a tracked stream
+// needs. Transport is filled in when registering.
+func twitchSubscriptionsFor(stream *streamInfo) []createSubscription {
+	broadcaster := map[string]string{"broadcaster_user_id": stream.UserId}
+	subs := []createSubscription{
+		{EventType: "stream.online", Version: "1", Condition: broadcaster},
+		{EventType: "stream.offline", Version: "1", Condition: broadcaster},
+		{EventType: "channel.update", Version: "1", Condition: broadcaster},
+	}
+	if config.Raids.Enabled {
+		subs = append(subs,
+			createSubscription{EventType: "channel.raid", Version: "1", Condition: map[string]string{"from_broadcaster_user_id": stream.UserId}},
+			createSubscription{EventType: "channel.raid", Version: "1", Condition: map[string]string{"to_broadcaster_user_id": stream.UserId}},
+		)
+	}
+	if config.Raids.Shoutouts {
+		// Needs the broadcaster to have granted moderator:read:shoutouts.
+		subs = append(subs, createSubscription{
+			EventType: "channel.shoutout.create",
+			Version:   "1",
+			Condition: map[string]string{"broadcaster_user_id": stream.UserId, "moderator_user_id": stream.UserId},
+		})
 	}
+	return subs
+}
 
-	log.Println(g)
-	return &g.Games[0]
+// hasSubscription reports whether subs contains one of eventType with the
+// same non-empty conditions.
+func hasSubscription(subs twitchSubscription, eventType string, conditions map[string]string) bool {
+	for _, sub := range subs.Data {
+		if sub.Type != eventType {
+			continue
+		}
+		matches := true
+		for key, value := range conditions {
+			if sub.Condition[key] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
 }
 
-func getSubscriptions(status string) twitchSubscription {
-	var s twitchSubscription
+// getTwitchClips returns up to first clips made between start and end, most
+// viewed first.
+func getTwitchClips(userId string, start time.Time, end time.Time, first int) ([]twitchClip, error) {
+	var c twitchClipJSON
 
-	req, _ := http.NewRequest("GET", "https://api.twitch.tv/helix/eventsub/subscriptions?status="+status, nil)
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
+	query := url.Values{}
+	query.Set("broadcaster_id", userId)
+	query.Set("started_at", start.UTC().Format(time.RFC3339))
+	query.Set("ended_at", end.UTC().Format(time.RFC3339))
+	query.Set("first", strconv.Itoa(first))
 
-	validateToken()
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
+	if err := helixGet("/clips?"+query.Encode(), &c); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return c.Clips, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
+// getTwitchSchedule returns the broadcaster's upcoming schedule. Streamers
+// without a schedule get an empty one.
+func getTwitchSchedule(userId string) (twitchSchedule, error) {
+	var sc twitchScheduleJSON
+	err := helixGet("/schedule?first=25&broadcaster_id="+userId, &sc)
+	var herr *helixError
+	if errors.As(err, &herr) && herr.StatusCode == http.StatusNotFound {
+		return twitchSchedule{}, nil
 	}
-
-	err = json.Unmarshal(body, &s)
-
 	if err != nil {
-		panic(err)
+		return twitchSchedule{}, err
 	}
-
-	return s
+	return sc.Schedule, nil
 }
 
-func deleteSubscription(subID string) {
-	req, _ := http.NewRequest("DELETE", "https://api.twitch.tv/helix/eventsub/subscriptions?id="+subID, nil)
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
+// getSubscriptions lists EventSub subscriptions with the given status, or
+// all of them when status is empty.
+func getSubscriptions(status string) (twitchSubscription, error) {
+	var s twitchSubscription
 
-	validateToken()
-	_, err := client.Do(req)
-	if err != nil {
-		panic(err)
+	path := "/eventsub/subscriptions"
+	if status != "" {
+		path += "?status=" + status
 	}
+	err := helixGet(path, &s)
+	return s, err
+}
 
+func deleteSubscription(subID string) error {
+	return helixRequest("DELETE", "/eventsub/subscriptions?id="+subID, nil, nil)
 }
 
-func registerTwitchWebhook(client *http.Client, userId string, eventType string) {
-	conditions := make(map[string]string)
-	conditions["broadcaster_user_id"] = userId
-	createSubscription := &createSubscription{
-		EventType: eventType,
-		Version:   "1",
-		Condition: conditions,
-		Transport: transport{
-			Method:   "webhook",
-			Callback: "https://" + config.Secrets.BaseUrl + "/notify",
-			Secret:   "ThisIsASecret",
-		},
+func registerTwitchWebhook(createSubscription createSubscription) error {
+	createSubscription.Transport = transport{
+		Method:   "webhook",
+		Callback: "https://" + config.Secrets.BaseUrl + "/notify",
+		Secret:   "ThisIsASecret",
 	}
-	body, _ := json.Marshal(createSubscription)
-	//log.Printf("Registering createSubscription: %s\n", string(body))
-
-	validateToken()
-
-	req, _ := http.NewRequest("POST", "https://api.twitch.tv/helix/eventsub/subscriptions", bytes.NewBuffer(body))
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
-	req.Header.Add("Content-type", "application/json")
-
-	log.Println("Registering webhook")
-	resp, err := client.Do(req)
+	body, err := json.Marshal(createSubscription)
 	if err != nil {
-		log.Println("Panic at webhook POST")
-		panic(err)
+		return err
 	}
-	defer resp.Body.Close()
-	// body, _ = ioutil.ReadAll(resp.Body)
-	log.Printf("Webhook returned: %s\n", resp.Status)
+
+	log.Printf("Registering webhook %v %v\n", createSubscription.EventType, createSubscription.Condition)
+	return helixRequest("POST", "/eventsub/subscriptions", body, nil)
 }
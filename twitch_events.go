@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// streamOnline, streamOffline and channelUpdate feed a Twitch event into the
+// stream's state machine. They are shared by the EventSub callback and the
+// polling detection mode so both behave the same.
+
+func streamOnline(channel *streamInfo, streamId string, streamType string, onlineDate time.Time) {
+	handleStreamEvent(channel, streamEvent{
+		Kind:       eventOnline,
+		StreamID:   streamId,
+		StreamType: streamType,
+		At:         onlineDate,
+	})
+}
+
+func streamOffline(channel *streamInfo) {
+	handleStreamEvent(channel, streamEvent{
+		Kind: eventOffline,
+		At:   time.Now(),
+	})
+}
+
+func channelUpdate(channel *streamInfo, title string, categoryId string) {
+	handleStreamEvent(channel, streamEvent{
+		Kind:       eventUpdate,
+		At:         time.Now(),
+		Title:      title,
+		CategoryID: categoryId,
+	})
+}
+
+const defaultUpdateWindow = 30 * time.Second
+
+// scheduleUpdate coalesces channel updates: the first update in a window
+// starts a timer and any more that arrive before it fires are folded into
+// the one edit. The caller must hold channel.mu.
+func scheduleUpdate(channel *streamInfo) {
+	window := defaultUpdateWindow
+	if config.UpdateWindow != "" {
+		if parsed, err := time.ParseDuration(config.UpdateWindow); err == nil {
+			window = parsed
+		}
+	}
+
+	if channel.updateTimer != nil {
+		return
+	}
+	channel.updateTimer = time.AfterFunc(window, func() {
+		defer recoverLog("Editing notification for " + channel.StreamName)
+		channel.mu.Lock()
+		defer channel.mu.Unlock()
+		channel.updateTimer = nil
+
+		if channel.Title == channel.postedTitle && channel.Category == channel.postedCategory {
+			log.Printf("Title and game for %v are unchanged, not editing\n", channel.StreamName)
+			return
+		}
+		if channel.State == stateLive && channel.Session != nil && announces(channel, channel.Session.StreamType) {
+			postNotification(channel, true)
+		}
+	})
+}
+
+// refreshNotification edits a live stream's messages outside of any event,
+// e.g. to show new viewer stats.
+func refreshNotification(channel *streamInfo) {
+	defer recoverLog("Refreshing notification for " + channel.StreamName)
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	if channel.State == stateLive && channel.Session != nil && announces(channel, channel.Session.StreamType) {
+		postNotification(channel, true)
+	}
+}
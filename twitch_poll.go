@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const defaultPollInterval = time.Minute
+
+// pollTwitchStreams is the detection_mode "poll" replacement for EventSub. It
+// compares /helix/streams and /helix/channels against what we last saw and
+// raises the same online, offline and update events the webhook would.
+func pollTwitchStreams() {
+	interval := defaultPollInterval
+	if config.PollInterval != "" {
+		parsed, err := time.ParseDuration(config.PollInterval)
+		if err != nil {
+			log.Printf("Invalid poll_interval, using %v: %v\n", interval, err)
+		} else {
+			interval = parsed
+		}
+	}
+
+	log.Printf("Polling Twitch every %v\n", interval)
+	for {
+		pollTwitchOnce()
+		time.Sleep(interval)
+	}
+}
+
+func pollTwitchOnce() {
+	defer recoverLog("Polling Twitch")
+
+	byUser := make(map[string]*streamInfo)
+	var userIds []string
+	for _, stream := range config.Streams {
+		if stream.Type == twitchType && stream.UserId != "" {
+			byUser[stream.UserId] = stream
+			userIds = append(userIds, stream.UserId)
+		}
+	}
+
+	live := make(map[string]twitchStream)
+	channels := make(map[string]twitchChannel)
+	for start := 0; start < len(userIds); start += helixBatchSize {
+		end := start + helixBatchSize
+		if end > len(userIds) {
+			end = len(userIds)
+		}
+		// A failed batch would look like every stream in it went
+		// offline, so skip this poll instead.
+		streams, err := getTwitchStreams(userIds[start:end])
+		if err != nil {
+			log.Printf("Could not get streams: %v\n", err)
+			return
+		}
+		for _, stream := range streams {
+			live[stream.UserID] = stream
+		}
+		batch, err := getTwitchChannels(userIds[start:end])
+		if err != nil {
+			log.Printf("Could not get channels: %v\n", err)
+			return
+		}
+		for _, channel := range batch {
+			channels[channel.ID] = channel
+		}
+	}
+
+	for userId, stream := range byUser {
+		stream.mu.Lock()
+		title, category, wasLive := stream.Title, stream.Category, stream.IsLive
+		stream.mu.Unlock()
+
+		// Updates come first so a stream that went live with a new title
+		// is announced with it, as EventSub usually orders them.
+		if channel, ok := channels[userId]; ok && (channel.Title != title || channel.GameID != category) {
+			channelUpdate(stream, channel.Title, channel.GameID)
+		}
+
+		current, isLive := live[userId]
+		if isLive && current.StreamType == "live" && !wasLive {
+			startedAt, err := time.Parse(time.RFC3339, current.StartedAt)
+			if err != nil {
+				startedAt = time.Now()
+			}
+			streamOnline(stream, current.ID, current.StreamType, startedAt)
+		} else if !isLive && wasLive {
+			streamOffline(stream)
+		}
+	}
+	writeConfig()
+}
@@ -1,6 +1,11 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
 
 type createSubscription struct {
 	EventType string            `json:"type"`
@@ -72,6 +77,78 @@ type twitchGameJSON struct {
 	Games []twitchGame `json:"data"`
 }
 
+type twitchStream struct {
+	ID          string `json:"id"`
+	UserID      string `json:"user_id"`
+	UserLogin   string `json:"user_login"`
+	GameID      string `json:"game_id"`
+	GameName    string `json:"game_name"`
+	StreamType  string `json:"type"`
+	Title       string `json:"title"`
+	ViewerCount int    `json:"viewer_count"`
+	StartedAt   string `json:"started_at"`
+}
+type twitchStreamJSON struct {
+	Streams []twitchStream `json:"data"`
+}
+
+type twitchVideo struct {
+	ID        string `json:"id"`
+	StreamID  string `json:"stream_id"`
+	UserID    string `json:"user_id"`
+	UserLogin string `json:"user_login"`
+	Title     string `json:"title"`
+	URL       string `json:"url"`
+	CreatedAt string `json:"created_at"`
+	Duration  string `json:"duration"`
+	VideoType string `json:"type"`
+	Thumbnail string `json:"thumbnail_url"`
+}
+type twitchVideoJSON struct {
+	Videos []twitchVideo `json:"data"`
+}
+
+type twitchClip struct {
+	ID              string `json:"id"`
+	URL             string `json:"url"`
+	BroadcasterID   string `json:"broadcaster_id"`
+	BroadcasterName string `json:"broadcaster_name"`
+	CreatorName     string `json:"creator_name"`
+	Title           string `json:"title"`
+	ViewCount       int    `json:"view_count"`
+	CreatedAt       string `json:"created_at"`
+	Thumbnail       string `json:"thumbnail_url"`
+}
+type twitchClipJSON struct {
+	Clips []twitchClip `json:"data"`
+}
+
+type twitchScheduleSegment struct {
+	ID            string `json:"id"`
+	StartTime     string `json:"start_time"`
+	EndTime       string `json:"end_time"`
+	Title         string `json:"title"`
+	CanceledUntil string `json:"canceled_until"`
+	Category      *struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"category"`
+	IsRecurring bool `json:"is_recurring"`
+}
+type twitchSchedule struct {
+	Segments         []twitchScheduleSegment `json:"segments"`
+	BroadcasterID    string                  `json:"broadcaster_id"`
+	BroadcasterName  string                  `json:"broadcaster_name"`
+	BroadcasterLogin string                  `json:"broadcaster_login"`
+	Vacation         *struct {
+		StartTime string `json:"start_time"`
+		EndTime   string `json:"end_time"`
+	} `json:"vacation"`
+}
+type twitchScheduleJSON struct {
+	Schedule twitchSchedule `json:"data"`
+}
+
 type twitchSubscription struct {
 	Total        int                `json:"total"`
 	Data         []subscriptionInfo `json:"data"`
@@ -82,24 +159,114 @@ type twitchSubscription struct {
 type discordChannel struct {
 	ChannelID string `json:"id"`
 	MessageID string `json:"message_id"`
+	// Crosspost publishes go-live and upload posts to following servers
+	// when the channel is an announcement channel.
+	Crosspost bool `json:"crosspost,omitempty"`
+	// ThreadName opens a thread on each go-live and upload post when set.
+	// {streamer}, {title} and {date} are filled in.
+	ThreadName string `json:"thread_name,omitempty"`
+	ThreadID   string `json:"thread_id,omitempty"`
+	// Buttons lists the link buttons shown under notifications, from
+	// "watch_twitch", "watch_youtube", "vod" and "subscribe".
+	Buttons []string `json:"buttons,omitempty"`
+	// RoleID is the stream's opt-in notification role in this channel's
+	// guild, managed by the bot when the stream or target has notify_role
+	// set.
+	RoleID     string `json:"role_id,omitempty"`
+	NotifyRole bool   `json:"notify_role,omitempty"`
+	// GuildID is set on targets that come from a guilds entry. They are
+	// rebuilt from it on every load.
+	GuildID string `json:"guild_id,omitempty"`
+	// Description and ColourString override the stream's own for posts to
+	// this channel.
+	Description     string `json:"description,omitempty"`
+	ColourString    string `json:"colour,omitempty"`
+	HighlightColour int64  `json:"highlight_colour,omitempty"`
+}
+
+// guildConfig is one server's view of the bot. Its streams are merged into
+// the shared streams list at load, so a streamer followed by several guilds
+// is only subscribed to once upstream.
+type guildConfig struct {
+	GuildID string `json:"guild_id"`
+	// Description and Colour are the defaults for every target in the
+	// guild.
+	Description string        `json:"description"`
+	Colour      string        `json:"colour"`
+	Streams     []guildStream `json:"streams"`
+}
+
+// guildStream picks a streamer by name (or youtube_channel) and lists where
+// in the guild it should be posted. Anything not set here falls back to the
+// guild, then to the shared stream.
+type guildStream struct {
+	StreamName  string           `json:"stream_name"`
+	Type        int              `json:"type"`
+	ChannelRef  string           `json:"youtube_channel"`
+	Description string           `json:"description"`
+	Colour      string           `json:"colour"`
+	NotifyRole  bool             `json:"notify_role"`
+	Channels    []discordChannel `json:"discord_channel_ids"`
 }
 
 type streamInfo struct {
-	StreamName      string           `json:"stream_name"`
-	UserId          string           `json:"twitch_user_id"`
+	StreamName string `json:"stream_name"`
+	UserId     string `json:"twitch_user_id"`
+	ChannelRef string `json:"youtube_channel"`
+	ChannelID  string `json:"youtube_channel_id"`
+	// ResolvedRef is the youtube_channel that ChannelID was resolved from,
+	// so editing youtube_channel resolves it again.
+	ResolvedRef string `json:"youtube_channel_resolved"`
+	// Aliases are other youtube_channel references found to be the same
+	// channel, so guild entries using them share this stream.
+	Aliases         []string         `json:"youtube_aliases,omitempty"`
 	Channels        []discordChannel `json:"discord_channel_ids"`
 	ColourString    string           `json:"colour"`
 	HighlightColour int64            `json:"highlight_colour"`
 	CurrentStreamID string           `json:"current_stream"`
 	Description     string           `json:"description"`
 	IsLive          bool             `json:"is_live"`
+	State           streamState      `json:"state"`
 	Category        string           `json:"category"`
 	Title           string           `json:"title"`
 	OfflineTime     int64            `json:"offline_time"`
 	LastOffline     int64            `json:"last_offline"`
-	Type            int              `json:"type"`
-	VideoIds        []string         `json:"video_ids"`
-	DisableOffline  bool             `json:"disable_offline"`
+	// StrayOffline is when an offline arrived while the stream wasn't
+	// live, so its online delivered late can be recognised as stale.
+	StrayOffline    int64               `json:"stray_offline,omitempty"`
+	Type            int                 `json:"type"`
+	VideoIds        []string            `json:"video_ids,omitempty"`
+	Videos          videoSet            `json:"posted_videos"`
+	VideoRetention  videoRetention      `json:"video_retention"`
+	Broadcasts      []*youtubeBroadcast `json:"youtube_broadcasts"`
+	Filters         youtubeFilters      `json:"youtube_filters"`
+	FeedPoll        string              `json:"feed_poll_interval"`
+	DisableOffline  bool                `json:"disable_offline"`
+	OfflineAction   string              `json:"offline_action"`
+	ShowLiveStats   bool                `json:"show_live_stats"`
+	AnnounceTypes   []string            `json:"announce_types"`
+	VodChannels     []string            `json:"vod_channel_ids"`
+	PostedVods      videoSet            `json:"posted_vods"`
+	SyncSchedule    bool                `json:"sync_schedule"`
+	NotifyRole      bool                `json:"notify_role"`
+	Followers       []follower          `json:"followers"`
+	LeaseExpires    int64               `json:"lease_expires"`
+	ScheduledEvents []scheduledEvent    `json:"scheduled_events"`
+	// GuildOnly marks streams added for a guilds entry rather than listed
+	// under streams. They are dropped once no guild wants them.
+	GuildOnly bool `json:"guild_only,omitempty"`
+
+	// mu serialises Discord sends and edits for the stream so concurrent
+	// notifications can't race on Channels[i].MessageID.
+	mu             sync.Mutex
+	updateTimer    *time.Timer
+	postedTitle    string
+	postedCategory string
+	// lastError and lastErrorAt are guarded by errorsMu rather than mu, so
+	// they can be recorded from anywhere.
+	lastError   string
+	lastErrorAt time.Time
+	Session     *streamSession `json:"session"`
 }
 
 type secrets struct {
@@ -107,11 +274,83 @@ type secrets struct {
 	TwitchClientID     string `json:"twitch_client_id"`
 	TwitchClientSecret string `json:"twitch_client_secret"`
 	BaseUrl            string `json:"url"`
+	YoutubeAPIKey      string `json:"youtube_api_key"`
 }
 
 type cofiguration struct {
 	Secrets secrets       `json:"secrets"`
 	Streams []*streamInfo `json:"streams"`
+	Guilds  []guildConfig `json:"guilds"`
+	// StatsInterval is how often live streams are sampled for viewer
+	// counts, in Go duration syntax. Sampling is off when empty.
+	StatsInterval string `json:"stats_interval"`
+	// DetectionMode picks how Twitch streams are watched: "eventsub"
+	// (the default) needs a public callback URL, "poll" does not.
+	DetectionMode string `json:"detection_mode"`
+	PollInterval  string `json:"poll_interval"`
+	// UpdateWindow is how long channel.update events are collected before
+	// the live message is edited. Defaults to 30s.
+	UpdateWindow string       `json:"update_window"`
+	Raids        raidSettings `json:"raids"`
+	// VodPollInterval is how often Twitch highlights and uploads are
+	// checked for streams with vod_channel_ids. Off when empty.
+	VodPollInterval string             `json:"vod_poll_interval"`
+	ClipDigest      clipDigestSettings `json:"clip_digest"`
+	// ScheduleInterval is how often Twitch schedules are synced to Discord
+	// scheduled events for streams with sync_schedule. Off when empty.
+	ScheduleInterval string     `json:"schedule_interval"`
+	RoleMenus        []roleMenu `json:"role_menus"`
+	// Presence is "count" (the default) for "Watching N streams live",
+	// "rotate" to cycle through live streamers, or "off".
+	Presence string `json:"presence"`
+}
+
+// follower is a member who gets a DM when the stream posts. Disabled is set
+// when their DMs turn out to be closed; following again re-enables it.
+type follower struct {
+	UserID   string `json:"user_id"`
+	Disabled bool   `json:"disabled"`
+}
+
+// roleMenu is a message with a button per stream that members press to opt
+// in to that stream's notification role.
+type roleMenu struct {
+	ChannelID string `json:"channel_id"`
+	MessageID string `json:"message_id"`
+	// MoreMessageIDs continue the menu when it has more buttons than fit
+	// in one message.
+	MoreMessageIDs []string `json:"more_message_ids,omitempty"`
+	Title          string   `json:"title"`
+}
+
+// scheduledEvent maps a Twitch schedule segment to the Discord scheduled
+// event created for it in one guild.
+type scheduledEvent struct {
+	SegmentID string `json:"segment_id"`
+	GuildID   string `json:"guild_id"`
+	EventID   string `json:"event_id"`
+	Name      string `json:"name"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+}
+
+// clipDigestSettings schedules the top clips digest. Period is "day" or
+// "week"; it is posted at Hour UTC, on Mondays for weekly digests.
+type clipDigestSettings struct {
+	Period   string   `json:"period"`
+	Hour     int      `json:"hour"`
+	Count    int      `json:"count"`
+	Channels []string `json:"channel_ids"`
+	LastRun  int64    `json:"last_run"`
+}
+
+// raidSettings controls raid and shoutout announcements. Channels are the
+// Discord channel ids they are posted to.
+type raidSettings struct {
+	Enabled     bool     `json:"enabled"`
+	Shoutouts   bool     `json:"shoutouts"`
+	TrackedOnly bool     `json:"tracked_only"`
+	Channels    []string `json:"channel_ids"`
 }
 
 type hub struct {
@@ -121,9 +360,162 @@ type hub struct {
 	LeaseSeconds int    `json:"hub.lease_seconds"`
 }
 
+type youtubeVideo struct {
+	ID      string `json:"id"`
+	Snippet struct {
+		ChannelID            string `json:"channelId"`
+		ChannelTitle         string `json:"channelTitle"`
+		Title                string `json:"title"`
+		PublishedAt          string `json:"publishedAt"`
+		LiveBroadcastContent string `json:"liveBroadcastContent"`
+		Thumbnails           map[string]struct {
+			URL string `json:"url"`
+		} `json:"thumbnails"`
+	} `json:"snippet"`
+	ContentDetails struct {
+		Duration string `json:"duration"`
+	} `json:"contentDetails"`
+	LiveStreamingDetails *struct {
+		ScheduledStartTime string `json:"scheduledStartTime"`
+		ActualStartTime    string `json:"actualStartTime"`
+		ActualEndTime      string `json:"actualEndTime"`
+		ConcurrentViewers  string `json:"concurrentViewers"`
+	} `json:"liveStreamingDetails"`
+}
+type youtubeVideoJSON struct {
+	Items []youtubeVideo `json:"items"`
+}
+
+type youtubeChannel struct {
+	ID string `json:"id"`
+}
+type youtubeChannelJSON struct {
+	Items []youtubeChannel `json:"items"`
+}
+
+// youtubeBroadcast is a live stream or premiere we have posted and are still
+// keeping up to date in Discord.
+type youtubeBroadcast struct {
+	VideoID  string           `json:"video_id"`
+	State    string           `json:"state"`
+	Premiere bool             `json:"premiere"`
+	Messages []discordChannel `json:"messages"`
+}
+
+// postedVideo is a YouTube video that has been announced, along with the
+// messages it was announced in.
+type postedVideo struct {
+	VideoID  string           `json:"video_id"`
+	PostedAt int64            `json:"posted_at"`
+	Messages []discordChannel `json:"messages,omitempty"`
+	// Skipped is why the video was filtered out instead of posted.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// videoRetention bounds how many posted videos are remembered per stream.
+// MaxCount defaults to 200; MaxAge uses Go duration syntax, e.g. "720h".
+type videoRetention struct {
+	MaxCount int    `json:"max_count"`
+	MaxAge   string `json:"max_age"`
+}
+
+// youtubeFilters decide which uploads are announced. Durations use Go syntax,
+// e.g. "90s" or "48h"; an empty MaxAge keeps the old 24 hour limit.
+type youtubeFilters struct {
+	ExcludeShorts bool   `json:"exclude_shorts"`
+	MinDuration   string `json:"min_duration"`
+	TitleAllow    string `json:"title_allow"`
+	TitleDeny     string `json:"title_deny"`
+	MaxAge        string `json:"max_age"`
+
+	minDuration time.Duration
+	maxAge      time.Duration
+	titleAllow  *regexp.Regexp
+	titleDeny   *regexp.Regexp
+}
+
 type Handler func(http.ResponseWriter, *http.Request) error
 
 const (
 	twitchType  = 1
 	youtubeType = 2
 )
+
+// streamSession is a single broadcast, from stream.online to stream.offline.
+type streamSession struct {
+	StreamID   string          `json:"stream_id"`
+	UserID     string          `json:"user_id"`
+	StreamName string          `json:"stream_name"`
+	StreamType string          `json:"stream_type"`
+	StartedAt  int64           `json:"started_at"`
+	EndedAt    int64           `json:"ended_at"`
+	Changes    []sessionChange `json:"changes"`
+	// Samples are only written to the session store. While the session
+	// is running they are kept in samples, and cfg.txt gets the running
+	// figures below instead.
+	Samples     []viewerSample `json:"samples,omitempty"`
+	PeakViewers int            `json:"peak_viewers"`
+	ViewerSum   int64          `json:"viewer_sum"`
+	SampleCount int            `json:"sample_count"`
+	LastViewers int            `json:"last_viewers"`
+	Reconnects  []reconnect    `json:"reconnects"`
+
+	samples []viewerSample
+}
+
+// reconnect is a drop within offline_time that the session carried on
+// through. StreamID is the id Twitch gave the resumed stream.
+type reconnect struct {
+	OfflineAt int64  `json:"offline_at"`
+	OnlineAt  int64  `json:"online_at"`
+	StreamID  string `json:"stream_id"`
+}
+
+// viewerSample is a snapshot of a live stream taken by the stats poller.
+type viewerSample struct {
+	At      int64  `json:"at"`
+	Viewers int    `json:"viewers"`
+	GameID  string `json:"game_id"`
+	Title   string `json:"title"`
+}
+
+// sessionChange is the title and category at a point in a session.
+type sessionChange struct {
+	At         int64  `json:"at"`
+	Title      string `json:"title"`
+	CategoryID string `json:"category_id"`
+}
+
+// The stream.online types Twitch sends.
+const (
+	streamTypeLive       = "live"
+	streamTypePlaylist   = "playlist"
+	streamTypeWatchParty = "watch_party"
+	streamTypePremiere   = "premiere"
+	streamTypeRerun      = "rerun"
+)
+
+const (
+	presenceCount  = "count"
+	presenceRotate = "rotate"
+	presenceOff    = "off"
+)
+
+const (
+	detectionEventSub = "eventsub"
+	detectionPoll     = "poll"
+)
+
+// What happens to a stream's live messages when it goes offline.
+const (
+	offlineSummary = "summary"
+	offlineDelete  = "delete"
+	offlineNone    = "none"
+)
+
+const (
+	youtubeUpload   = "upload"
+	youtubeUpcoming = "upcoming"
+	youtubeLive     = "live"
+	youtubeEnded    = "ended"
+)
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+const (
+	defaultVideoRetention = 200
+	// youtubeFeedSize is how many entries the upload feed returns. Keeping
+	// fewer than that would let the poller re-post videos it has forgotten.
+	youtubeFeedSize = 15
+)
+
+// videoSet is the set of YouTube videos posted for a stream, keyed by video
+// id. It is stored as a list in cfg.txt, oldest first.
+type videoSet struct {
+	videos map[string]*postedVideo
+}
+
+func (s *videoSet) has(videoId string) bool {
+	_, ok := s.videos[videoId]
+	return ok
+}
+
+func (s *videoSet) get(videoId string) *postedVideo {
+	return s.videos[videoId]
+}
+
+func (s *videoSet) add(video *postedVideo) {
+	if s.videos == nil {
+		s.videos = make(map[string]*postedVideo)
+	}
+	s.videos[video.VideoID] = video
+}
+
+func (s *videoSet) len() int {
+	return len(s.videos)
+}
+
+// sorted returns the videos oldest first.
+func (s *videoSet) sorted() []*postedVideo {
+	videos := make([]*postedVideo, 0, len(s.videos))
+	for _, video := range s.videos {
+		videos = append(videos, video)
+	}
+	sort.Slice(videos, func(i, j int) bool {
+		return videos[i].PostedAt < videos[j].PostedAt
+	})
+	return videos
+}
+
+// prune drops videos older than maxAge and then the oldest videos until at
+// most maxCount remain, but never leaves fewer than minCount. A zero limit is
+// ignored.
+func (s *videoSet) prune(maxCount int, maxAge time.Duration, minCount int, now time.Time) {
+	videos := s.sorted()
+	for i, video := range videos {
+		if len(videos)-i <= minCount {
+			break
+		}
+		tooOld := maxAge > 0 && now.Sub(time.Unix(video.PostedAt, 0)) > maxAge
+		tooMany := maxCount > 0 && len(videos)-i > maxCount
+		if !tooOld && !tooMany {
+			break
+		}
+		delete(s.videos, video.VideoID)
+	}
+}
+
+func (s videoSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.sorted())
+}
+
+func (s *videoSet) UnmarshalJSON(data []byte) error {
+	var videos []*postedVideo
+	if err := json.Unmarshal(data, &videos); err != nil {
+		return err
+	}
+	s.videos = make(map[string]*postedVideo, len(videos))
+	for _, video := range videos {
+		s.videos[video.VideoID] = video
+	}
+	return nil
+}
+
+// record adds a posted video to the set and applies the retention settings.
+// At least minCount videos are kept and nothing younger than minAge is
+// pruned: anything the source could still offer us would be re-posted if we
+// forgot about it.
+func (s *videoSet) record(video *postedVideo, retention videoRetention, minCount int, minAge time.Duration) {
+	s.add(video)
+
+	maxCount := retention.MaxCount
+	if maxCount == 0 {
+		maxCount = defaultVideoRetention
+	}
+	if maxCount < minCount {
+		maxCount = minCount
+	}
+
+	var maxAge time.Duration
+	if retention.MaxAge != "" {
+		maxAge, _ = time.ParseDuration(retention.MaxAge)
+		if maxAge < minAge {
+			maxAge = minAge
+		}
+	}
+
+	s.prune(maxCount, maxAge, minCount, time.Now())
+}
+
+// recordVideo adds a posted YouTube video to the stream's set.
+func recordVideo(channel *streamInfo, video *postedVideo) {
+	channel.Videos.record(video, channel.VideoRetention, youtubeFeedSize, channel.Filters.maxAge)
+}
+
+// migrateVideoIds moves ids from the old unbounded video_ids list into the
+// video set. Their post times are unknown, so they are treated as posted now.
+func migrateVideoIds(channel *streamInfo) {
+	now := time.Now().Unix()
+	for _, videoId := range channel.VideoIds {
+		if !channel.Videos.has(videoId) {
+			channel.Videos.add(&postedVideo{VideoID: videoId, PostedAt: now})
+		}
+	}
+	channel.VideoIds = nil
+}
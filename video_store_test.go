@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVideoSetRetentionFloor(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention videoRetention
+		postedAt  int64
+	}{
+		{"max_count", videoRetention{MaxCount: 5}, time.Now().Unix()},
+		// Everything is past max_age, but the latest pages are still kept.
+		{"max_age", videoRetention{MaxAge: "720h"}, time.Now().Add(-1000 * time.Hour).Unix()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var set videoSet
+			for i := 0; i < 50; i++ {
+				set.record(&postedVideo{VideoID: fmt.Sprint(i), PostedAt: tt.postedAt + int64(i)}, tt.retention, vodRetentionFloor, 0)
+			}
+			if set.len() != vodRetentionFloor {
+				t.Errorf("kept %d videos, want %d", set.len(), vodRetentionFloor)
+			}
+			if set.has("9") || !set.has("10") {
+				t.Error("pruned the wrong end of the set")
+			}
+		})
+	}
+}
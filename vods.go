@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// pollTwitchVods checks each stream with VOD targets for new highlights and
+// uploads. Anything already in PostedVods is skipped, the same way YouTube
+// uploads are deduplicated.
+func pollTwitchVods() {
+	interval, err := time.ParseDuration(config.VodPollInterval)
+	if err != nil {
+		log.Printf("Invalid vod_poll_interval: %v\n", err)
+		return
+	}
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+
+	first := true
+	for {
+		for _, stream := range config.Streams {
+			if stream.Type == twitchType && len(stream.VodChannels) > 0 {
+				pollStreamVods(stream, first)
+			}
+		}
+		writeConfig()
+		first = false
+		time.Sleep(interval)
+	}
+}
+
+// vodRetentionFloor is how many posted VODs are always remembered: each poll
+// sees a page of highlights and a page of uploads.
+const vodRetentionFloor = 2 * twitchVideoPage
+
+func pollStreamVods(stream *streamInfo, first bool) {
+	defer recoverLog("Polling VODs for " + stream.StreamName)
+
+	var videos []twitchVideo
+	for _, videoType := range []string{"highlight", "upload"} {
+		page, err := getTwitchVideos(stream.UserId, videoType)
+		if err != nil {
+			log.Printf("Could not get %v videos for %v: %v\n", videoType, stream.StreamName, err)
+			return
+		}
+		videos = append(videos, page...)
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	// Don't announce a back catalogue the first time a stream is polled.
+	if first && stream.PostedVods.len() == 0 {
+		for _, video := range videos {
+			stream.PostedVods.record(&postedVideo{VideoID: video.ID, PostedAt: time.Now().Unix()}, stream.VideoRetention, vodRetentionFloor, 0)
+		}
+		return
+	}
+	postVods(stream, videos)
+}
+
+// postVods posts any of videos that haven't been posted for the stream
+// before to its VOD targets. The caller must hold stream.mu.
+func postVods(stream *streamInfo, videos []twitchVideo) {
+	if len(stream.VodChannels) == 0 {
+		return
+	}
+
+	var discord *discordgo.Session
+	for _, video := range videos {
+		if stream.PostedVods.has(video.ID) {
+			continue
+		}
+		if discord == nil {
+			discord = createDiscordSession()
+			defer discord.Close()
+		}
+
+		posted := &postedVideo{VideoID: video.ID, PostedAt: time.Now().Unix()}
+		embed := vodEmbed(stream, video)
+		for _, channelID := range stream.VodChannels {
+			msg, err := discord.ChannelMessageSendEmbed(channelID, embed)
+			if err != nil {
+				streamError(stream, "%v did not send: %v\n", channelID, err)
+				continue
+			}
+			posted.Messages = append(posted.Messages, discordChannel{ChannelID: channelID, MessageID: msg.ID})
+		}
+		stream.PostedVods.record(posted, stream.VideoRetention, vodRetentionFloor, 0)
+	}
+}
+
+var vodLabels = map[string]string{
+	"archive":   "Past broadcast",
+	"highlight": "New highlight",
+	"upload":    "New upload",
+}
+
+func vodEmbed(stream *streamInfo, video twitchVideo) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Author: &discordgo.MessageEmbedAuthor{
+			URL:  "https://www.twitch.tv/" + stream.StreamName,
+			Name: stream.StreamName,
+		},
+		Color:       int(stream.HighlightColour),
+		Title:       video.Title,
+		URL:         video.URL,
+		Description: vodLabels[video.VideoType],
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   "Length",
+				Value:  video.Duration,
+				Inline: true,
+			},
+		},
+	}
+	// Thumbnails for archives still being processed are empty.
+	if video.Thumbnail != "" {
+		embed.Image = &discordgo.MessageEmbedImage{
+			URL: strings.Replace(strings.Replace(video.Thumbnail, "%{width}", "640", 1), "%{height}", "360", 1),
+		}
+	}
+	return embed
+}
@@ -7,8 +7,11 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/mmcdole/gofeed/atom"
 )
 
@@ -16,7 +19,7 @@ func setupYouTubeNotification(channel *streamInfo) {
 	hub := &hub{
 		Callback:     "https://" + config.Secrets.BaseUrl + "/youtube",
 		Mode:         "subscribe",
-		Topic:        "https://www.youtube.com/xml/feeds/videos.xml?channel_id=" + channel.UserId,
+		Topic:        "https://www.youtube.com/xml/feeds/videos.xml?channel_id=" + channel.ChannelID,
 		LeaseSeconds: 604800,
 	}
 	body, _ := json.Marshal(hub)
@@ -25,7 +28,7 @@ func setupYouTubeNotification(channel *streamInfo) {
 	req, _ := http.NewRequest("POST", "https://pubsubhubbub.appspot.com/subscribe?hub.verify=async&hub.callback="+hub.Callback+"&hub.mode="+hub.Mode+"&hub.topic="+hub.Topic+"&hub.lease_seconds="+fmt.Sprint(hub.LeaseSeconds), bytes.NewBuffer(body))
 	req.Header.Add("Content-type", "application/json")
 
-	log.Println("Registering webhook for channel: " + channel.UserId)
+	log.Println("Registering webhook for channel: " + channel.ChannelID)
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Println("Panic at webhook POST")
@@ -41,6 +44,26 @@ func setupYouTubeNotification(channel *streamInfo) {
 	go renewWebhook(channel)
 }
 
+// recordLease notes when a verified WebSub subscription will expire, from
+// the hub's verification request.
+func recordLease(query url.Values) {
+	if query.Get("hub.mode") != "subscribe" {
+		return
+	}
+	topic, err := url.Parse(query.Get("hub.topic"))
+	if err != nil {
+		return
+	}
+	channel := findChannel(topic.Query().Get("channel_id"), youtubeType)
+	seconds, err := strconv.Atoi(query.Get("hub.lease_seconds"))
+	if channel == nil || err != nil {
+		return
+	}
+	channel.mu.Lock()
+	channel.LeaseExpires = time.Now().Add(time.Duration(seconds) * time.Second).Unix()
+	channel.mu.Unlock()
+}
+
 func renewWebhook(channel *streamInfo) {
 	time.Sleep(144 * time.Hour)
 	setupYouTubeNotification(channel)
@@ -52,6 +75,7 @@ func handleYoutubeNotification(w http.ResponseWriter, r *http.Request) (err erro
 
 	if challenge != "" {
 		log.Printf("Challenge is: %v\n", challenge)
+		recordLease(r.URL.Query())
 		w.Write([]byte(challenge))
 	} else {
 		w.WriteHeader(http.StatusNoContent)
@@ -60,39 +84,364 @@ func handleYoutubeNotification(w http.ResponseWriter, r *http.Request) (err erro
 
 		atomParser := atom.Parser{}
 		feed, atomError := atomParser.Parse(r.Body)
-		if err != nil {
+		if atomError != nil {
 			log.Println(atomError)
 			return
 		}
 		log.Println(feed)
+		handleYoutubeFeed(feed)
+	}
+	return
+}
 
-		channel := findChannel(feed.Entries[0].Extensions["yt"]["channelId"][0].Value, youtubeType)
-		if channel == nil {
-			return
+// handleYoutubeFeed posts any entries in feed that haven't been seen before.
+// Both the WebSub callback and the RSS poller end up here.
+func handleYoutubeFeed(feed *atom.Feed) {
+	if len(feed.Entries) == 0 {
+		return
+	}
+	channel := findChannel(feed.Entries[0].Extensions["yt"]["channelId"][0].Value, youtubeType)
+	if channel == nil {
+		return
+	}
+
+	// Holding mu throughout means a push and a poll for the same video
+	// can't both decide it hasn't been posted yet.
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	var pending []*atom.Entry
+	for _, entry := range feed.Entries {
+		videoId := entry.Extensions["yt"]["videoId"][0].Value
+		if findBroadcast(channel, videoId) != nil || !channel.Videos.has(videoId) {
+			pending = append(pending, entry)
 		}
+	}
+	if len(pending) == 0 {
+		return
+	}
 
-		if feed.Entries[0].PublishedParsed.Before(time.Now().UTC().Add(-24 * time.Hour)) {
-			log.Printf("Video is older than 24 hours\n")
-			return
+	discord := createDiscordSession()
+	defer discord.Close()
+
+	for _, entry := range pending {
+		postYoutubeEntry(discord, channel, entry)
+	}
+	writeConfig()
+}
+
+// postYoutubeEntry announces a single feed entry. The caller must hold
+// channel.mu. Live streams and premieres
+// get a Twitch-style embed which is tracked so it can be edited as the
+// broadcast progresses; everything else is announced as a plain upload.
+func postYoutubeEntry(discord *discordgo.Session, channel *streamInfo, entry *atom.Entry) {
+	videoId := entry.Extensions["yt"]["videoId"][0].Value
+
+	if broadcast := findBroadcast(channel, videoId); broadcast != nil {
+		refreshBroadcast(discord, channel, broadcast)
+		return
+	}
+
+	if channel.Videos.has(videoId) {
+		log.Printf("Video %v has already been posted\n", videoId)
+		return
+	}
+	if reason := filterYoutubeEntry(channel, entry); reason != "" {
+		skipVideo(channel, videoId, reason)
+		return
+	}
+
+	var video *youtubeVideo
+	if videoFetcher != nil {
+		videos, err := videoFetcher.fetchVideos([]string{videoId})
+		if err != nil {
+			streamError(channel, "Could not fetch metadata for %v: %v\n", videoId, err)
+		} else if len(videos) > 0 {
+			video = &videos[0]
 		}
+	}
 
-		for _, video := range channel.VideoIds {
-			if video == feed.Entries[0].Extensions["yt"]["videoId"][0].Value {
-				log.Printf("Video %v has already been posted\n", video)
-				return
+	if state := broadcastState(video); state != youtubeUpload && state != youtubeEnded {
+		broadcast := &youtubeBroadcast{
+			VideoID:  videoId,
+			State:    state,
+			Premiere: isPremiere(video),
+		}
+		sendBroadcast(discord, channel, broadcast, video)
+		go updatePresence()
+		announcement := " is live on YouTube: "
+		if state == youtubeUpcoming {
+			announcement = " has scheduled a YouTube stream: "
+		}
+		notifyFollowers(channel, &discordgo.MessageSend{
+			Content: channel.StreamName + announcement + "https://www.youtube.com/watch?v=" + videoId,
+		})
+		channel.Broadcasts = append(channel.Broadcasts, broadcast)
+		recordVideo(channel, &postedVideo{
+			VideoID:  videoId,
+			PostedAt: time.Now().Unix(),
+			Messages: broadcast.Messages,
+		})
+		return
+	}
+
+	if reason := filterYoutubeUpload(channel, entry, video); reason != "" {
+		skipVideo(channel, videoId, reason)
+		return
+	}
+
+	posted := &postedVideo{VideoID: videoId, PostedAt: time.Now().Unix()}
+	links := youtubeButtonLinks(channel, videoId)
+	for _, target := range channel.Channels {
+		msg, err := discord.ChannelMessageSendComplex(target.ChannelID, &discordgo.MessageSend{
+			Content:    entry.Authors[0].Name + " has posted a new video: " + entry.Links[0].Href,
+			Components: linkButtons(target, links),
+		})
+		if err != nil {
+			streamError(channel, "%v did not send: %v\n", target.ChannelID, err)
+			continue
+		}
+		// Upload threads are left to auto-archive, there's no end to wait
+		// for.
+		target.MessageID = msg.ID
+		afterSend(discord, channel, &target, entry.Title)
+		posted.Messages = append(posted.Messages, discordChannel{
+			ChannelID: target.ChannelID,
+			MessageID: msg.ID,
+		})
+	}
+	recordVideo(channel, posted)
+	notifyFollowers(channel, &discordgo.MessageSend{
+		Content: entry.Authors[0].Name + " has posted a new video: " + entry.Links[0].Href,
+	})
+}
+
+// skipVideo remembers a filtered video alongside the posted ones, so later
+// polls don't fetch and filter it all over again.
+func skipVideo(channel *streamInfo, videoId string, reason string) {
+	log.Printf("Skipping video %v for %v: %v\n", videoId, channel.StreamName, reason)
+	recordVideo(channel, &postedVideo{
+		VideoID:  videoId,
+		PostedAt: time.Now().Unix(),
+		Skipped:  reason,
+	})
+}
+
+// broadcastState works out where a video is in its broadcast lifecycle. A
+// video without metadata is treated as a plain upload.
+func broadcastState(video *youtubeVideo) string {
+	if video == nil || video.LiveStreamingDetails == nil {
+		return youtubeUpload
+	}
+	if video.LiveStreamingDetails.ActualEndTime != "" {
+		return youtubeEnded
+	}
+	switch video.Snippet.LiveBroadcastContent {
+	case "upcoming":
+		return youtubeUpcoming
+	case "live":
+		return youtubeLive
+	}
+	return youtubeUpload
+}
+
+// isPremiere reports whether a broadcast is a premiere rather than a live
+// stream. Premieres are pre-recorded so they already have a duration, live
+// streams report P0D until they end.
+func isPremiere(video *youtubeVideo) bool {
+	if video == nil || video.LiveStreamingDetails == nil {
+		return false
+	}
+	duration := video.ContentDetails.Duration
+	return duration != "" && duration != "P0D"
+}
+
+func findBroadcast(channel *streamInfo, videoId string) *youtubeBroadcast {
+	for _, broadcast := range channel.Broadcasts {
+		if broadcast.VideoID == videoId {
+			return broadcast
+		}
+	}
+	return nil
+}
+
+func sendBroadcast(discord *discordgo.Session, channel *streamInfo, broadcast *youtubeBroadcast, video *youtubeVideo) {
+	embed := youtubeBroadcastEmbed(channel, broadcast, video)
+	message := &discordgo.MessageSend{}
+
+	links := youtubeButtonLinks(channel, broadcast.VideoID)
+	var title string
+	if video != nil {
+		title = video.Snippet.Title
+	}
+	for _, target := range channel.Channels {
+		message.Content = roleMention(channel, target) + targetDescription(channel, target)
+		message.Components = linkButtons(target, links)
+		message.Embeds = []*discordgo.MessageEmbed{targetEmbed(target, embed)}
+		msg, err := discord.ChannelMessageSendComplex(target.ChannelID, message)
+		if err != nil {
+			streamError(channel, "%v did not send: %v\n", target.ChannelID, err)
+			continue
+		}
+		target.MessageID = msg.ID
+		afterSend(discord, channel, &target, title)
+		broadcast.Messages = append(broadcast.Messages, discordChannel{
+			ChannelID: target.ChannelID,
+			MessageID: msg.ID,
+			ThreadID:  target.ThreadID,
+		})
+	}
+}
+
+// refreshBroadcast fetches the latest metadata for a tracked broadcast and
+// edits its messages if the state has moved on, DMing followers when an
+// upcoming broadcast goes live. Ended broadcasts are dropped from the tracked
+// list.
+func refreshBroadcast(discord *discordgo.Session, channel *streamInfo, broadcast *youtubeBroadcast) {
+	if videoFetcher == nil {
+		return
+	}
+	videos, err := videoFetcher.fetchVideos([]string{broadcast.VideoID})
+	if err != nil {
+		streamError(channel, "Could not fetch metadata for %v: %v\n", broadcast.VideoID, err)
+		return
+	}
+
+	state := youtubeEnded
+	var video *youtubeVideo
+	if len(videos) > 0 {
+		video = &videos[0]
+		state = broadcastState(video)
+		if state == youtubeUpload {
+			state = youtubeEnded
+		}
+	}
+	if state == broadcast.State {
+		return
+	}
+
+	log.Printf("Broadcast %v is now %v\n", broadcast.VideoID, state)
+	wasUpcoming := broadcast.State == youtubeUpcoming
+	broadcast.State = state
+	go updatePresence()
+	// Followers were only told it was scheduled, so tell them it started.
+	if wasUpcoming && state == youtubeLive {
+		notifyFollowers(channel, &discordgo.MessageSend{
+			Content: channel.StreamName + " is live on YouTube: https://www.youtube.com/watch?v=" + broadcast.VideoID,
+		})
+	}
+	embed := youtubeBroadcastEmbed(channel, broadcast, video)
+	links := youtubeButtonLinks(channel, broadcast.VideoID)
+	for _, message := range broadcast.Messages {
+		target := findTarget(channel, message.ChannelID)
+		err := editMessage(discord, target, message.MessageID, targetEmbed(target, embed), links)
+		if err != nil {
+			streamError(channel, "%v did not edit: %v\n", message.MessageID, err)
+		}
+	}
+
+	if state == youtubeEnded {
+		archiveThreads(broadcast.Messages)
+		for i, b := range channel.Broadcasts {
+			if b == broadcast {
+				channel.Broadcasts = append(channel.Broadcasts[:i], channel.Broadcasts[i+1:]...)
+				break
 			}
 		}
+	}
+}
+
+func youtubeBroadcastEmbed(channel *streamInfo, broadcast *youtubeBroadcast, video *youtubeVideo) *discordgo.MessageEmbed {
+	videoURL := "https://www.youtube.com/watch?v=" + broadcast.VideoID
+	embed := &discordgo.MessageEmbed{
+		Color: int(channel.HighlightColour),
+		URL:   videoURL,
+		Title: videoURL,
+	}
+
+	status := "Live now"
+	if broadcast.Premiere {
+		status = "Premiering now"
+	}
+	switch broadcast.State {
+	case youtubeUpcoming:
+		status = "Upcoming stream"
+		if broadcast.Premiere {
+			status = "Upcoming premiere"
+		}
+	case youtubeEnded:
+		status = "Ended"
+	}
+	embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+		Name:   "Status",
+		Value:  status,
+		Inline: true,
+	})
+
+	if video == nil {
+		return embed
+	}
+
+	embed.Title = video.Snippet.Title
+	embed.Author = &discordgo.MessageEmbedAuthor{
+		URL:  "https://www.youtube.com/channel/" + video.Snippet.ChannelID,
+		Name: video.Snippet.ChannelTitle,
+	}
+	for _, size := range []string{"maxres", "high", "medium", "default"} {
+		if thumbnail, ok := video.Snippet.Thumbnails[size]; ok {
+			embed.Image = &discordgo.MessageEmbedImage{URL: thumbnail.URL}
+			break
+		}
+	}
+
+	details := video.LiveStreamingDetails
+	if broadcast.State == youtubeUpcoming && details.ScheduledStartTime != "" {
+		if start, err := time.Parse(time.RFC3339, details.ScheduledStartTime); err == nil {
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+				Name:   "Starts",
+				Value:  fmt.Sprintf("<t:%d:R>", start.Unix()),
+				Inline: true,
+			})
+		}
+	}
+	if broadcast.State == youtubeEnded && details.ActualStartTime != "" && details.ActualEndTime != "" {
+		start, startErr := time.Parse(time.RFC3339, details.ActualStartTime)
+		end, endErr := time.Parse(time.RFC3339, details.ActualEndTime)
+		if startErr == nil && endErr == nil {
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+				Name:   "Duration",
+				Value:  end.Sub(start).Round(time.Minute).String(),
+				Inline: true,
+			})
+		}
+	}
+	return embed
+}
 
-		discord := createDiscordSession()
-		defer discord.Close()
+// watchYoutubeBroadcasts periodically refreshes every tracked broadcast so
+// upcoming streams flip to live and live streams are marked as ended even
+// if the hub never pushes the update.
+func watchYoutubeBroadcasts(interval time.Duration) {
+	for {
+		time.Sleep(interval)
 
-		for _, entry := range feed.Entries {
-			for _, discordChannel := range channel.Channels {
-				discord.ChannelMessageSend(discordChannel.ChannelID, entry.Authors[0].Name+" has posted a new video: "+entry.Links[0].Href)
+		var discord *discordgo.Session
+		for _, stream := range config.Streams {
+			if stream.Type != youtubeType {
+				continue
+			}
+			stream.mu.Lock()
+			if len(stream.Broadcasts) > 0 && discord == nil {
+				discord = createDiscordSession()
 			}
-			channel.VideoIds = append(channel.VideoIds, feed.Entries[0].Extensions["yt"]["videoId"][0].Value)
+			for _, broadcast := range append([]*youtubeBroadcast(nil), stream.Broadcasts...) {
+				refreshBroadcast(discord, stream, broadcast)
+			}
+			stream.mu.Unlock()
+		}
+		if discord != nil {
+			discord.Close()
+			writeConfig()
 		}
-		writeConfig()
 	}
-	return
 }
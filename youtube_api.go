@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// videoMetadataFetcher looks up metadata for YouTube videos. The WebSub feed
+// only tells us a video exists, so anything more (live state, schedule) has
+// to come from here. Swap videoFetcher for a stub in tests.
+type videoMetadataFetcher interface {
+	fetchVideos(ids []string) ([]youtubeVideo, error)
+}
+
+var videoFetcher videoMetadataFetcher
+
+// youtubeChannelResolver turns an @handle, legacy username or custom URL into
+// the UC... channel id the feeds are keyed on. Swap channelResolver for a
+// stub in tests.
+type youtubeChannelResolver interface {
+	resolveChannel(ref youtubeChannelRef) (string, error)
+}
+
+var channelResolver youtubeChannelResolver
+
+// youtubeChannelRef is a parsed user-supplied reference to a YouTube channel.
+// Exactly one field is set.
+type youtubeChannelRef struct {
+	ChannelID string
+	Handle    string
+	Username  string
+	Custom    string
+}
+
+// youtubeDataClient is a videoMetadataFetcher and youtubeChannelResolver
+// backed by the YouTube Data API v3.
+type youtubeDataClient struct {
+	apiKey  string
+	client  *http.Client
+	baseURL string
+}
+
+func newYoutubeDataClient(apiKey string, client *http.Client) *youtubeDataClient {
+	return &youtubeDataClient{
+		apiKey:  apiKey,
+		client:  client,
+		baseURL: "https://www.googleapis.com/youtube/v3",
+	}
+}
+
+func (c *youtubeDataClient) fetchVideos(ids []string) ([]youtubeVideo, error) {
+	var videos youtubeVideoJSON
+
+	query := url.Values{}
+	query.Set("part", "snippet,liveStreamingDetails,contentDetails")
+	query.Set("id", strings.Join(ids, ","))
+	query.Set("key", c.apiKey)
+
+	if err := c.get("/videos?"+query.Encode(), &videos); err != nil {
+		return nil, err
+	}
+	return videos.Items, nil
+}
+
+func (c *youtubeDataClient) resolveChannel(ref youtubeChannelRef) (string, error) {
+	if ref.ChannelID != "" {
+		return ref.ChannelID, nil
+	}
+
+	query := url.Values{}
+	query.Set("key", c.apiKey)
+	query.Set("part", "id")
+	switch {
+	case ref.Handle != "":
+		query.Set("forHandle", "@"+ref.Handle)
+	case ref.Username != "":
+		query.Set("forUsername", ref.Username)
+	default:
+		// Custom /c/ URLs have no lookup of their own. Most became the
+		// channel's handle; search would only give a best guess, and a
+		// wrong guess would quietly follow someone else's channel.
+		query.Set("forHandle", "@"+ref.Custom)
+	}
+
+	var channels youtubeChannelJSON
+	if err := c.get("/channels?"+query.Encode(), &channels); err != nil {
+		return "", err
+	}
+	if len(channels.Items) == 0 {
+		if ref.Custom != "" {
+			return "", fmt.Errorf("no youtube channel has the handle @%v, use the channel's @handle or /channel/ URL instead", ref.Custom)
+		}
+		return "", fmt.Errorf("no youtube channel found for %+v", ref)
+	}
+	return channels.Items[0].ID, nil
+}
+
+// parseYoutubeChannelRef accepts a raw channel id, an @handle, or any of the
+// youtube.com/channel, /@handle, /user and /c URL forms.
+func parseYoutubeChannelRef(input string) (youtubeChannelRef, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return youtubeChannelRef{}, fmt.Errorf("empty youtube channel")
+	}
+	if strings.HasPrefix(input, "@") {
+		return youtubeChannelRef{Handle: strings.TrimPrefix(input, "@")}, nil
+	}
+	if isYoutubeChannelID(input) {
+		return youtubeChannelRef{ChannelID: input}, nil
+	}
+
+	if !strings.Contains(input, "://") {
+		input = "https://" + input
+	}
+	u, err := url.Parse(input)
+	if err != nil {
+		return youtubeChannelRef{}, err
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	host = strings.TrimPrefix(host, "m.")
+	if host != "youtube.com" {
+		return youtubeChannelRef{}, fmt.Errorf("%v is not a youtube channel", input)
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case strings.HasPrefix(parts[0], "@"):
+		return youtubeChannelRef{Handle: strings.TrimPrefix(parts[0], "@")}, nil
+	case len(parts) > 1 && parts[0] == "channel" && isYoutubeChannelID(parts[1]):
+		return youtubeChannelRef{ChannelID: parts[1]}, nil
+	case len(parts) > 1 && parts[0] == "user":
+		return youtubeChannelRef{Username: parts[1]}, nil
+	case len(parts) > 1 && parts[0] == "c":
+		return youtubeChannelRef{Custom: parts[1]}, nil
+	case len(parts) == 1 && parts[0] != "":
+		return youtubeChannelRef{Custom: parts[0]}, nil
+	}
+	return youtubeChannelRef{}, fmt.Errorf("%v is not a youtube channel", input)
+}
+
+func isYoutubeChannelID(s string) bool {
+	return len(s) == 24 && strings.HasPrefix(s, "UC")
+}
+
+// resolveYoutubeChannel fills in channel.ChannelID from whatever the user
+// configured. It only talks to the resolver when the configured reference
+// changes, otherwise the persisted id is used.
+func resolveYoutubeChannel(channel *streamInfo) error {
+	input := channel.ChannelRef
+	if input == "" {
+		// Older configs put the channel id in twitch_user_id.
+		input = channel.UserId
+	}
+	if channel.ChannelID != "" {
+		if channel.ResolvedRef == "" {
+			// Resolved before the reference was remembered.
+			channel.ResolvedRef = input
+		}
+		if channel.ResolvedRef == input {
+			return nil
+		}
+	}
+
+	ref, err := parseYoutubeChannelRef(input)
+	if err != nil {
+		return err
+	}
+	if ref.ChannelID == "" {
+		if channelResolver == nil {
+			return fmt.Errorf("%v needs a youtube api key to resolve", input)
+		}
+		if ref.ChannelID, err = channelResolver.resolveChannel(ref); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Resolved youtube channel %v to %v\n", input, ref.ChannelID)
+	channel.ChannelID = ref.ChannelID
+	channel.ResolvedRef = input
+	if channel.UserId == ref.ChannelID {
+		channel.UserId = ""
+		channel.ChannelRef = input
+	}
+	return nil
+}
+
+func (c *youtubeDataClient) get(path string, v any) error {
+	resp, err := c.client.Get(c.baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("youtube api returned %s: %s", resp.Status, string(body))
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseYoutubeChannelRef(t *testing.T) {
+	const id = "UCabcdefghijklmnopqrstuv"
+	tests := []struct {
+		input string
+		want  youtubeChannelRef
+	}{
+		{id, youtubeChannelRef{ChannelID: id}},
+		{"@someone", youtubeChannelRef{Handle: "someone"}},
+		{"https://www.youtube.com/@someone", youtubeChannelRef{Handle: "someone"}},
+		{"youtube.com/@someone/videos", youtubeChannelRef{Handle: "someone"}},
+		{"https://m.youtube.com/@someone", youtubeChannelRef{Handle: "someone"}},
+		{"https://www.youtube.com/channel/" + id, youtubeChannelRef{ChannelID: id}},
+		{"http://youtube.com/channel/" + id + "/live", youtubeChannelRef{ChannelID: id}},
+		{"https://www.youtube.com/user/someone", youtubeChannelRef{Username: "someone"}},
+		{"https://www.youtube.com/c/Someone", youtubeChannelRef{Custom: "Someone"}},
+		{"https://www.youtube.com/Someone", youtubeChannelRef{Custom: "Someone"}},
+		{"  @someone  ", youtubeChannelRef{Handle: "someone"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseYoutubeChannelRef(tt.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYoutubeChannelRefErrors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"https://www.twitch.tv/someone",
+		"https://www.youtube.com/",
+		"https://www.youtube.com/channel/not-an-id",
+	} {
+		if ref, err := parseYoutubeChannelRef(input); err == nil {
+			t.Errorf("%q: expected an error, got %+v", input, ref)
+		}
+	}
+}
+
+// stubResolver is a youtubeChannelResolver that maps handles to ids.
+type stubResolver struct {
+	handles map[string]string
+	calls   int
+}
+
+func (r *stubResolver) resolveChannel(ref youtubeChannelRef) (string, error) {
+	r.calls++
+	return r.handles[ref.Handle], nil
+}
+
+func TestResolveYoutubeChannel(t *testing.T) {
+	resolver := &stubResolver{handles: map[string]string{
+		"first":  "UCfirstxxxxxxxxxxxxxxxxx",
+		"second": "UCsecondxxxxxxxxxxxxxxxx",
+	}}
+	old := channelResolver
+	channelResolver = resolver
+	t.Cleanup(func() { channelResolver = old })
+
+	channel := &streamInfo{ChannelRef: "@first"}
+	if err := resolveYoutubeChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+	if channel.ChannelID != "UCfirstxxxxxxxxxxxxxxxxx" {
+		t.Errorf("ChannelID = %v", channel.ChannelID)
+	}
+
+	// The persisted id is used while the reference is unchanged.
+	if err := resolveYoutubeChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+	if resolver.calls != 1 {
+		t.Errorf("resolver called %d times, want 1", resolver.calls)
+	}
+
+	channel.ChannelRef = "https://www.youtube.com/@second"
+	if err := resolveYoutubeChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+	if channel.ChannelID != "UCsecondxxxxxxxxxxxxxxxx" {
+		t.Errorf("ChannelID after changing youtube_channel = %v", channel.ChannelID)
+	}
+}
+
+func TestResolveLegacyYoutubeChannel(t *testing.T) {
+	old := channelResolver
+	channelResolver = nil
+	t.Cleanup(func() { channelResolver = old })
+
+	// Older configs have the id in twitch_user_id and nothing to resolve.
+	channel := &streamInfo{UserId: "UCabcdefghijklmnopqrstuv"}
+	if err := resolveYoutubeChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+	if channel.ChannelID != "UCabcdefghijklmnopqrstuv" || channel.UserId != "" {
+		t.Errorf("got ChannelID %q, UserId %q", channel.ChannelID, channel.UserId)
+	}
+	if err := resolveYoutubeChannel(channel); err != nil {
+		t.Errorf("resolving again: %v", err)
+	}
+
+	// Ids resolved before the reference was remembered are kept.
+	channel = &streamInfo{ChannelRef: "@someone", ChannelID: "UCabcdefghijklmnopqrstuv"}
+	if err := resolveYoutubeChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+	if channel.ResolvedRef != "@someone" {
+		t.Errorf("ResolvedRef = %q", channel.ResolvedRef)
+	}
+}
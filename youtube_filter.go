@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/mmcdole/gofeed/atom"
+)
+
+const defaultYoutubeMaxAge = 24 * time.Hour
+
+// compileYoutubeFilters parses the duration and regex settings once at load
+// time so a typo in the config fails loudly instead of on the first upload.
+func compileYoutubeFilters(filters *youtubeFilters) (err error) {
+	filters.maxAge = defaultYoutubeMaxAge
+	if filters.MaxAge != "" {
+		if filters.maxAge, err = time.ParseDuration(filters.MaxAge); err != nil {
+			return fmt.Errorf("max_age: %w", err)
+		}
+	}
+	if filters.MinDuration != "" {
+		if filters.minDuration, err = time.ParseDuration(filters.MinDuration); err != nil {
+			return fmt.Errorf("min_duration: %w", err)
+		}
+	}
+	if filters.TitleAllow != "" {
+		if filters.titleAllow, err = regexp.Compile(filters.TitleAllow); err != nil {
+			return fmt.Errorf("title_allow: %w", err)
+		}
+	}
+	if filters.TitleDeny != "" {
+		if filters.titleDeny, err = regexp.Compile(filters.TitleDeny); err != nil {
+			return fmt.Errorf("title_deny: %w", err)
+		}
+	}
+	return nil
+}
+
+// filterYoutubeEntry returns why a feed entry should not be announced, or an
+// empty string if it should. It only looks at the feed itself, so it runs
+// before any metadata is fetched.
+func filterYoutubeEntry(channel *streamInfo, entry *atom.Entry) string {
+	filters := &channel.Filters
+
+	maxAge := filters.maxAge
+	if maxAge == 0 {
+		maxAge = defaultYoutubeMaxAge
+	}
+	if entry.PublishedParsed != nil && entry.PublishedParsed.Before(time.Now().UTC().Add(-maxAge)) {
+		return fmt.Sprintf("older than %v", maxAge)
+	}
+
+	if filters.titleAllow != nil && !filters.titleAllow.MatchString(entry.Title) {
+		return fmt.Sprintf("title %q does not match %v", entry.Title, filters.TitleAllow)
+	}
+	if filters.titleDeny != nil && filters.titleDeny.MatchString(entry.Title) {
+		return fmt.Sprintf("title %q matches %v", entry.Title, filters.TitleDeny)
+	}
+	return ""
+}
+
+// filterYoutubeUpload returns why an upload that passed filterYoutubeEntry
+// should not be announced, or an empty string if it should. video may be nil
+// when no API key is configured, in which case the duration filter can't be
+// applied and is skipped.
+func filterYoutubeUpload(channel *streamInfo, entry *atom.Entry, video *youtubeVideo) string {
+	filters := &channel.Filters
+
+	if filters.minDuration > 0 && video != nil {
+		duration, err := parseISODuration(video.ContentDetails.Duration)
+		if err == nil && duration < filters.minDuration {
+			return fmt.Sprintf("shorter than %v", filters.minDuration)
+		}
+	}
+
+	if filters.ExcludeShorts {
+		videoId := entry.Extensions["yt"]["videoId"][0].Value
+		short, err := isYoutubeShort(videoId)
+		if err != nil {
+			log.Printf("Could not check if %v is a short: %v\n", videoId, err)
+		} else if short {
+			return "video is a short"
+		}
+	}
+	return ""
+}
+
+// isYoutubeShort asks youtube.com/shorts about the video. Shorts are served
+// from there directly, anything else is redirected to /watch.
+func isYoutubeShort(videoId string) (bool, error) {
+	noRedirect := &http.Client{
+		Transport: client.Transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := noRedirect.Head("https://www.youtube.com/shorts/" + videoId)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+var isoDurationRegex = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseISODuration parses the ISO 8601 durations the Data API returns, e.g.
+// PT1H2M3S.
+func parseISODuration(s string) (time.Duration, error) {
+	match := isoDurationRegex.FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	var duration time.Duration
+	units := []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second}
+	for i, unit := range units {
+		if match[i+1] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(match[i+1])
+		if err != nil {
+			return 0, err
+		}
+		duration += time.Duration(n) * unit
+	}
+	return duration, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/mmcdole/gofeed/atom"
+)
+
+// pollYoutubeFeed fetches the channel's public upload feed on a jittered
+// interval as a fallback for pushes the hub delays or drops. Results go
+// through handleYoutubeFeed, so anything already pushed is not posted again.
+func pollYoutubeFeed(channel *streamInfo, interval time.Duration) {
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	first := true
+	for {
+		// +/- 20% so polls for many channels don't line up.
+		jitter := time.Duration(rand.Int63n(int64(interval)*2/5)) - interval/5
+		time.Sleep(interval + jitter)
+
+		feed, err := fetchYoutubeFeed(channel.ChannelID)
+		if err != nil {
+			streamError(channel, "Could not poll youtube feed for %v: %v\n", channel.StreamName, err)
+			continue
+		}
+
+		// A channel we've never posted for would otherwise have its whole
+		// recent history announced on the first poll.
+		if first && channel.Videos.len() == 0 {
+			channel.mu.Lock()
+			for _, entry := range feed.Entries {
+				recordVideo(channel, &postedVideo{
+					VideoID:  entry.Extensions["yt"]["videoId"][0].Value,
+					PostedAt: time.Now().Unix(),
+				})
+			}
+			channel.mu.Unlock()
+			writeConfig()
+		} else {
+			handleYoutubeFeed(feed)
+		}
+		first = false
+	}
+}
+
+func fetchYoutubeFeed(channelId string) (*atom.Feed, error) {
+	resp, err := client.Get("https://www.youtube.com/feeds/videos.xml?channel_id=" + channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	atomParser := atom.Parser{}
+	return atomParser.Parse(resp.Body)
+}
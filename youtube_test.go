@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mmcdole/gofeed/atom"
+)
+
+// stubFetcher is a videoMetadataFetcher serving canned videos.
+type stubFetcher struct {
+	videos map[string]youtubeVideo
+	calls  int
+}
+
+func (f *stubFetcher) fetchVideos(ids []string) ([]youtubeVideo, error) {
+	f.calls++
+	var videos []youtubeVideo
+	for _, id := range ids {
+		if video, ok := f.videos[id]; ok {
+			videos = append(videos, video)
+		}
+	}
+	return videos, nil
+}
+
+func parseVideo(t *testing.T, content string) youtubeVideo {
+	t.Helper()
+	var video youtubeVideo
+	if err := json.Unmarshal([]byte(content), &video); err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+const (
+	uploadVideo   = `{"id":"v1","snippet":{"liveBroadcastContent":"none"},"contentDetails":{"duration":"PT5M"}}`
+	upcomingVideo = `{"id":"v1","snippet":{"liveBroadcastContent":"upcoming"},"contentDetails":{"duration":"P0D"},"liveStreamingDetails":{"scheduledStartTime":"2030-01-01T00:00:00Z"}}`
+	liveVideo     = `{"id":"v1","snippet":{"liveBroadcastContent":"live"},"contentDetails":{"duration":"P0D"},"liveStreamingDetails":{"actualStartTime":"2030-01-01T00:00:00Z"}}`
+	premiereVideo = `{"id":"v1","snippet":{"liveBroadcastContent":"upcoming"},"contentDetails":{"duration":"PT12M"},"liveStreamingDetails":{"scheduledStartTime":"2030-01-01T00:00:00Z"}}`
+	endedVideo    = `{"id":"v1","snippet":{"liveBroadcastContent":"none"},"contentDetails":{"duration":"PT1H"},"liveStreamingDetails":{"actualStartTime":"2030-01-01T00:00:00Z","actualEndTime":"2030-01-01T01:00:00Z"}}`
+)
+
+func TestBroadcastState(t *testing.T) {
+	tests := []struct {
+		name  string
+		video string
+		want  string
+	}{
+		{"upload", uploadVideo, youtubeUpload},
+		{"upcoming", upcomingVideo, youtubeUpcoming},
+		{"live", liveVideo, youtubeLive},
+		{"premiere", premiereVideo, youtubeUpcoming},
+		{"ended", endedVideo, youtubeEnded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			video := parseVideo(t, tt.video)
+			if got := broadcastState(&video); got != tt.want {
+				t.Errorf("broadcastState = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got := broadcastState(nil); got != youtubeUpload {
+		t.Errorf("broadcastState(nil) = %v, want %v", got, youtubeUpload)
+	}
+}
+
+func TestIsPremiere(t *testing.T) {
+	tests := []struct {
+		name  string
+		video string
+		want  bool
+	}{
+		{"upload", uploadVideo, false},
+		{"live stream", liveVideo, false},
+		{"upcoming stream", upcomingVideo, false},
+		{"premiere", premiereVideo, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			video := parseVideo(t, tt.video)
+			if got := isPremiere(&video); got != tt.want {
+				t.Errorf("isPremiere = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if isPremiere(nil) {
+		t.Error("isPremiere(nil) = true, want false")
+	}
+}
+
+func feedEntry(t *testing.T, videoId string) *atom.Entry {
+	t.Helper()
+	feed, err := (&atom.Parser{}).Parse(strings.NewReader(`<feed xmlns="http://www.w3.org/2005/Atom" xmlns:yt="http://www.youtube.com/xml/schemas/2015">
+<entry>
+<yt:videoId>` + videoId + `</yt:videoId>
+<yt:channelId>UCxxxxxxxxxxxxxxxxxxxxxx</yt:channelId>
+<title>A video</title>
+<link rel="alternate" href="https://www.youtube.com/watch?v=` + videoId + `"/>
+<author><name>Someone</name></author>
+</entry>
+</feed>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return feed.Entries[0]
+}
+
+// withFetcher swaps in a stub fetcher and an empty config for the test.
+func withFetcher(t *testing.T, fetcher videoMetadataFetcher) {
+	oldFetcher, oldConfig := videoFetcher, config
+	videoFetcher, config = fetcher, &cofiguration{}
+	t.Cleanup(func() {
+		videoFetcher, config = oldFetcher, oldConfig
+	})
+}
+
+func TestBroadcastLifecycle(t *testing.T) {
+	fetcher := &stubFetcher{videos: map[string]youtubeVideo{"v1": parseVideo(t, upcomingVideo)}}
+	withFetcher(t, fetcher)
+	channel := &streamInfo{StreamName: "someone", Type: youtubeType}
+	entry := feedEntry(t, "v1")
+
+	postYoutubeEntry(nil, channel, entry)
+	if len(channel.Broadcasts) != 1 || channel.Broadcasts[0].State != youtubeUpcoming {
+		t.Fatalf("after upcoming: broadcasts %+v", channel.Broadcasts)
+	}
+	if !channel.Videos.has("v1") {
+		t.Error("upcoming broadcast was not recorded as posted")
+	}
+
+	// Seeing the same entry again refreshes the tracked broadcast rather
+	// than posting it a second time.
+	fetcher.videos["v1"] = parseVideo(t, liveVideo)
+	postYoutubeEntry(nil, channel, entry)
+	if len(channel.Broadcasts) != 1 || channel.Broadcasts[0].State != youtubeLive {
+		t.Fatalf("after live: broadcasts %+v", channel.Broadcasts)
+	}
+
+	fetcher.videos["v1"] = parseVideo(t, endedVideo)
+	refreshBroadcast(nil, channel, channel.Broadcasts[0])
+	if len(channel.Broadcasts) != 0 {
+		t.Fatalf("ended broadcast is still tracked: %+v", channel.Broadcasts)
+	}
+
+	// Once ended the video is a plain posted video and isn't announced
+	// again.
+	calls := fetcher.calls
+	postYoutubeEntry(nil, channel, entry)
+	if fetcher.calls != calls || len(channel.Broadcasts) != 0 {
+		t.Error("ended broadcast was handled again")
+	}
+}
+
+func TestPremiereIsTracked(t *testing.T) {
+	withFetcher(t, &stubFetcher{videos: map[string]youtubeVideo{"v1": parseVideo(t, premiereVideo)}})
+	channel := &streamInfo{StreamName: "someone", Type: youtubeType}
+
+	postYoutubeEntry(nil, channel, feedEntry(t, "v1"))
+	if len(channel.Broadcasts) != 1 || !channel.Broadcasts[0].Premiere {
+		t.Fatalf("premiere not tracked: %+v", channel.Broadcasts)
+	}
+}
+
+func TestUploadIsNotTracked(t *testing.T) {
+	withFetcher(t, &stubFetcher{videos: map[string]youtubeVideo{"v1": parseVideo(t, uploadVideo)}})
+	channel := &streamInfo{StreamName: "someone", Type: youtubeType}
+
+	postYoutubeEntry(nil, channel, feedEntry(t, "v1"))
+	if len(channel.Broadcasts) != 0 {
+		t.Errorf("upload tracked as a broadcast: %+v", channel.Broadcasts)
+	}
+	if !channel.Videos.has("v1") {
+		t.Error("upload was not recorded as posted")
+	}
+}
+
+func TestFilteredEntryIsRemembered(t *testing.T) {
+	fetcher := &stubFetcher{videos: map[string]youtubeVideo{"v1": parseVideo(t, uploadVideo)}}
+	withFetcher(t, fetcher)
+	channel := &streamInfo{StreamName: "someone", Type: youtubeType}
+	channel.Filters.TitleDeny = "(?i)video"
+	if err := compileYoutubeFilters(&channel.Filters); err != nil {
+		t.Fatal(err)
+	}
+
+	postYoutubeEntry(nil, channel, feedEntry(t, "v1"))
+	if fetcher.calls != 0 {
+		t.Errorf("metadata fetched %d times for a filtered title", fetcher.calls)
+	}
+	video := channel.Videos.get("v1")
+	if video == nil || video.Skipped == "" {
+		t.Fatalf("filtered entry not remembered: %+v", video)
+	}
+}